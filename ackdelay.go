@@ -0,0 +1,34 @@
+package netemlite
+
+//
+// Delaying write acknowledgements
+//
+
+import "time"
+
+// SetAckDelay sets the delay between the moment in which the network is done with
+// a datagram, because it delivered or dropped it, and the moment in which the write
+// that sent the datagram returns, which models a slow local send path independently
+// of when the receiver gets the datagram. Because the write deadline still applies,
+// a write may fail with [os.ErrDeadlineExceeded] even though the network delivered
+// its datagram. A zero or negative value, which is the default, disables the delay.
+func (n *Network) SetAckDelay(d time.Duration) {
+	n.mu.Lock()
+	n.ackDelay = d
+	n.mu.Unlock()
+}
+
+// ackWrite unblocks the writer, possibly after the configured ack delay, in
+// which case we use a timer to avoid blocking the background goroutine.
+func (n *Network) ackWrite(write *networkWriteUDP) {
+	n.mu.Lock()
+	delay := n.ackDelay
+	n.mu.Unlock()
+	if delay <= 0 {
+		close(write.ack)
+		return
+	}
+	time.AfterFunc(delay, func() {
+		close(write.ack)
+	})
+}
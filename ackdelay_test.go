@@ -0,0 +1,46 @@
+package netemlite
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAckDelay(t *testing.T) {
+	n := newTestNetwork(t)
+	n.SetAckDelay(100 * time.Millisecond)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+
+	// the receiver gets the datagram before the write returns
+	start := time.Now()
+	errch := writeAsync(sender, "hello")
+	mustRead(t, receiver, "hello")
+	select {
+	case err := <-errch:
+		t.Fatalf("the write returned before the ack delay: %v", err)
+	default:
+	}
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("expected at least 100ms, got %v", elapsed)
+	}
+}
+
+func TestAckDelayExceedsWriteDeadline(t *testing.T) {
+	n := newTestNetwork(t)
+	n.SetAckDelay(time.Hour)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	sender.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+
+	// the write times out even though the network delivered the datagram
+	errch := writeAsync(sender, "hello")
+	mustRead(t, receiver, "hello")
+	if err := <-errch; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected ErrDeadlineExceeded, got %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package netemlite
+
+//
+// Allocating addresses for port-zero binds
+//
+
+import (
+	"net/netip"
+	"syscall"
+)
+
+// AddressAllocator allocates the local address of conns bound to port zero.
+type AddressAllocator interface {
+	// Allocate returns the address for a conn whose family is either "udp4"
+	// or "udp6". When the returned address is unspecified, the network only
+	// uses its port and keeps the address the conn asked to bind to.
+	Allocate(family string) (netip.AddrPort, error)
+}
+
+const (
+	// ephemeralPortFirst is the first ephemeral port (see RFC 6335).
+	ephemeralPortFirst = 49152
+
+	// ephemeralPortCount is the number of ephemeral ports.
+	ephemeralPortCount = 1<<16 - ephemeralPortFirst
+)
+
+// ephemeralAllocator is the default [AddressAllocator], which cycles through
+// the ephemeral ports independently for each family.
+type ephemeralAllocator struct {
+	// next maps each family to the offset of the next port to allocate.
+	next map[string]int
+}
+
+var _ AddressAllocator = &ephemeralAllocator{}
+
+// newEphemeralAllocator creates a new [ephemeralAllocator].
+func newEphemeralAllocator() *ephemeralAllocator {
+	return &ephemeralAllocator{next: map[string]int{}}
+}
+
+// Allocate implements AddressAllocator.
+func (a *ephemeralAllocator) Allocate(family string) (netip.AddrPort, error) {
+	offset := a.next[family]
+	a.next[family] = (offset + 1) % ephemeralPortCount
+	addr := netip.IPv6Unspecified()
+	if family == "udp4" {
+		addr = netip.IPv4Unspecified()
+	}
+	return netip.AddrPortFrom(addr, uint16(ephemeralPortFirst+offset)), nil
+}
+
+// SetAddressAllocator sets the [AddressAllocator] that provides the local address
+// of conns bound to port zero. The default allocator cycles through the ephemeral
+// ports. The allocator runs in the background goroutine of the network and MUST
+// NOT block or call methods that wait for that goroutine, such as Dump. If the
+// allocator returns an address that is already in use, the network asks for
+// another address, until it has tried as many addresses as there are ephemeral
+// ports, after which the bind fails with [syscall.EADDRINUSE]. A nil value
+// restores the default allocator.
+func (n *Network) SetAddressAllocator(a AddressAllocator) {
+	if a == nil {
+		a = newEphemeralAllocator()
+	}
+	n.mu.Lock()
+	n.addressAllocator = a
+	n.mu.Unlock()
+}
+
+// allocateAddr returns the address where to bind a conn, which differs from the
+// requested address only when the requested port is zero.
+func (n *Network) allocateAddr(requested netip.AddrPort) (netip.AddrPort, error) {
+	// binding to a nonzero port does not need allocation
+	if !requested.IsValid() || requested.Port() != 0 {
+		return requested, nil
+	}
+
+	n.mu.Lock()
+	allocator := n.addressAllocator
+	n.mu.Unlock()
+
+	family := "udp6"
+	if requested.Addr().Is4() {
+		family = "udp4"
+	}
+
+	for attempt := 0; attempt < ephemeralPortCount; attempt++ {
+		allocated, err := allocator.Allocate(family)
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		if allocated.Addr().IsUnspecified() {
+			allocated = netip.AddrPortFrom(requested.Addr(), allocated.Port())
+		}
+		if n.udp[allocated] == nil {
+			return allocated, nil
+		}
+	}
+	return netip.AddrPort{}, syscall.EADDRINUSE
+}
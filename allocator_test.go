@@ -0,0 +1,101 @@
+package netemlite
+
+import (
+	"errors"
+	"net/netip"
+	"syscall"
+	"testing"
+)
+
+// poolAllocator is an [AddressAllocator] handing out the addresses of a pool.
+type poolAllocator struct {
+	// addrs contains the addresses to hand out.
+	addrs []netip.AddrPort
+
+	// families contains the families passed to Allocate.
+	families []string
+}
+
+// Allocate implements AddressAllocator.
+func (a *poolAllocator) Allocate(family string) (netip.AddrPort, error) {
+	a.families = append(a.families, family)
+	if len(a.addrs) <= 0 {
+		return netip.AddrPort{}, syscall.EADDRNOTAVAIL
+	}
+	addr := a.addrs[0]
+	a.addrs = a.addrs[1:]
+	return addr, nil
+}
+
+func TestDefaultAddressAllocator(t *testing.T) {
+	n := newTestNetwork(t)
+	newTestConn(t, n, "10.0.0.1:49153", "")
+	first := newTestConn(t, n, "10.0.0.1:0", "")
+	second := newTestConn(t, n, "10.0.0.1:0", "")
+	third := newTestConn(t, n, "[::1]:0", "")
+
+	// the allocator skips the port in use and cycles independently for each family
+	for _, tc := range []struct {
+		conn   *UDPConn
+		expect string
+	}{
+		{conn: first, expect: "10.0.0.1:49152"},
+		{conn: second, expect: "10.0.0.1:49154"},
+		{conn: third, expect: "[::1]:49152"},
+	} {
+		if got := tc.conn.LocalAddr().String(); got != tc.expect {
+			t.Fatalf("expected %s, got %s", tc.expect, got)
+		}
+	}
+}
+
+func TestCustomAddressAllocator(t *testing.T) {
+	n := newTestNetwork(t)
+	allocator := &poolAllocator{
+		addrs: []netip.AddrPort{
+			netip.MustParseAddrPort("10.0.0.5:4000"),
+			netip.MustParseAddrPort("0.0.0.0:4001"),
+		},
+	}
+	n.SetAddressAllocator(allocator)
+
+	// an unspecified address means that we only use the allocated port
+	first := newTestConn(t, n, "10.0.0.1:0", "")
+	second := newTestConn(t, n, "10.0.0.1:0", "")
+	if first.LocalAddr().String() != "10.0.0.5:4000" || second.LocalAddr().String() != "10.0.0.1:4001" {
+		t.Fatal("unexpected addresses", first.LocalAddr(), second.LocalAddr())
+	}
+
+	// the allocator errors cause the bind to fail
+	if _, err := NewUDPConn(n, netip.MustParseAddrPort("10.0.0.1:0"), netip.AddrPort{}); !errors.Is(err, syscall.EADDRNOTAVAIL) {
+		t.Fatalf("expected EADDRNOTAVAIL, got %v", err)
+	}
+	if len(allocator.families) != 3 || allocator.families[0] != "udp4" {
+		t.Fatalf("unexpected families %v", allocator.families)
+	}
+
+	// binding to a nonzero port does not use the allocator
+	newTestConn(t, n, "10.0.0.1:53", "")
+	if len(allocator.families) != 3 {
+		t.Fatalf("unexpected families %v", allocator.families)
+	}
+
+	// a nil allocator restores the default allocator
+	n.SetAddressAllocator(nil)
+	if conn := newTestConn(t, n, "10.0.0.1:0", ""); conn.LocalAddr().String() != "10.0.0.1:49152" {
+		t.Fatal("unexpected address", conn.LocalAddr())
+	}
+}
+
+func TestAddressAllocatorExhausted(t *testing.T) {
+	n := newTestNetwork(t)
+	newTestConn(t, n, "10.0.0.1:4000", "")
+	allocator := &poolAllocator{}
+	for idx := 0; idx < ephemeralPortCount; idx++ {
+		allocator.addrs = append(allocator.addrs, netip.MustParseAddrPort("10.0.0.1:4000"))
+	}
+	n.SetAddressAllocator(allocator)
+	if _, err := NewUDPConn(n, netip.MustParseAddrPort("10.0.0.1:0"), netip.AddrPort{}); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Fatalf("expected EADDRINUSE, got %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package netemlite
+
+//
+// Delaying binds
+//
+
+import (
+	"net"
+	"time"
+)
+
+// SetBindDelay sets the delay before the network binds a new conn, which models a
+// slow-to-start listener and allows exercising the retry logic of clients. During
+// the delay, [NewUDPConn] blocks and the address is not bound yet, so datagrams sent
+// to it are lost, while the network keeps servicing other requests. A zero or
+// negative value, which is the default, disables the delay.
+func (n *Network) SetBindDelay(d time.Duration) {
+	n.mu.Lock()
+	n.bindDelay = d
+	n.mu.Unlock()
+}
+
+// waitBindDelay waits for the bind delay to elapse in the caller's goroutine,
+// such that we do not block the background goroutine, and fails with
+// [net.ErrClosed] if the network is closed in the meanwhile.
+func (n *Network) waitBindDelay() error {
+	n.mu.Lock()
+	delay := n.bindDelay
+	n.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-n.closed:
+		return net.ErrClosed
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,64 @@
+package netemlite
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestBindDelay(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "")
+	receiver := newTestConn(t, n, "10.0.0.3:53", "")
+	n.SetBindDelay(100 * time.Millisecond)
+
+	// start binding in the background
+	type result struct {
+		conn *UDPConn
+		err  error
+	}
+	start := time.Now()
+	resultch := make(chan result, 1)
+	go func() {
+		conn, err := NewUDPConn(n, netip.MustParseAddrPort("10.0.0.2:53"), netip.AddrPort{})
+		resultch <- result{conn, err}
+	}()
+
+	// the network keeps working and the address is not bound yet
+	writeToAsync(sender, "hello", "10.0.0.3:53")
+	mustRead(t, receiver, "hello")
+	if err := <-writeToAsync(sender, "lost", "10.0.0.2:53"); err != nil {
+		t.Fatal(err)
+	}
+	if drops := n.Stats().Drops[DropReasonNoSuchConn]; drops != 1 {
+		t.Fatalf("expected one drop, got %d", drops)
+	}
+
+	// the bind completes after the delay
+	res := <-resultch
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	defer res.conn.Close()
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("expected at least 100ms, got %v", elapsed)
+	}
+	writeToAsync(sender, "world", "10.0.0.2:53")
+	mustRead(t, res.conn, "world")
+}
+
+func TestBindDelayNetworkClosed(t *testing.T) {
+	n := NewNetwork()
+	n.SetBindDelay(time.Hour)
+	errch := make(chan error, 1)
+	go func() {
+		_, err := NewUDPConn(n, netip.MustParseAddrPort("10.0.0.2:53"), netip.AddrPort{})
+		errch <- err
+	}()
+	n.Close()
+	if err := <-errch; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
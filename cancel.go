@@ -0,0 +1,67 @@
+package netemlite
+
+//
+// Canceling all the pending operations
+//
+
+import "syscall"
+
+// networkCancelAllPending is a request to fail all the blocked reads and writes.
+type networkCancelAllPending struct {
+	// ack is closed by the Network layer to acknowledge that
+	// it has processed this message.
+	ack chan any
+
+	// err is the error with which to fail reads and writes.
+	err error
+}
+
+// CancelAllPending fails all the reads waiting for a datagram and all the writes
+// waiting for a reader with the given error, which simulates a transient total
+// failure, such as an interface reset. Unlike Close, this method does not close
+// the network or the conns, which you can keep using afterwards. Because the
+// failed writes did not deliver their datagrams, they are not counted as drops,
+// but they still return after the ack delay (see SetAckDelay). A nil error means [syscall.ENETRESET]. Reads and writes issued while the network
+// is paused (see Pause) are not affected, since the network has not seen them yet.
+func (n *Network) CancelAllPending(err error) {
+	if err == nil {
+		err = syscall.ENETRESET
+	}
+	req := &networkCancelAllPending{
+		ack: make(chan any),
+		err: err,
+	}
+	select {
+	case <-n.closed:
+		// nothing
+
+	case n.cancelAllPending <- req:
+		select {
+		case <-n.closed:
+			// nothing
+
+		case <-req.ack:
+			// nothing
+		}
+	}
+}
+
+// onCancelAllPending handles a request to fail all the blocked reads and writes.
+func (n *Network) onCancelAllPending(req *networkCancelAllPending) {
+	// always acknowledge the caller
+	defer close(req.ack)
+
+	for _, state := range n.udp {
+		for _, read := range state.blockedReads {
+			read.err = req.err
+			close(read.ack)
+		}
+		state.blockedReads = []*networkReadUDP{}
+
+		for _, write := range state.blockedWrites {
+			write.err = req.err
+			n.ackWrite(write)
+		}
+		state.clearWrites()
+	}
+}
@@ -0,0 +1,89 @@
+package netemlite
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCancelAllPending(t *testing.T) {
+	n := newTestNetwork(t)
+	readers := []*UDPConn{
+		newTestConn(t, n, "10.0.0.1:53", ""),
+		newTestConn(t, n, "10.0.0.2:53", ""),
+		newTestConn(t, n, "10.0.0.3:53", ""),
+	}
+	sender := newTestConn(t, n, "10.0.0.4:1234", "")
+	receiver := newTestConn(t, n, "10.0.0.5:53", "")
+
+	// block several reads and a write
+	var readchs []chan error
+	for _, conn := range readers {
+		readch := make(chan error, 1)
+		go func(conn *UDPConn) {
+			_, _, err := conn.ReadFrom(make([]byte, 64))
+			readch <- err
+		}(conn)
+		waitBlockedReads(t, n, conn.LocalAddr().String(), 1)
+		readchs = append(readchs, readch)
+	}
+	writech := writeToAsync(sender, "hello", "10.0.0.5:53")
+	waitBlockedWrites(t, n, "10.0.0.5:53", 1)
+
+	// all of them fail with the given error
+	n.CancelAllPending(syscall.ENETRESET)
+	for _, readch := range readchs {
+		if err := <-readch; !errors.Is(err, syscall.ENETRESET) {
+			t.Fatalf("expected ENETRESET, got %v", err)
+		}
+	}
+	if err := <-writech; !errors.Is(err, syscall.ENETRESET) {
+		t.Fatalf("expected ENETRESET, got %v", err)
+	}
+	waitBlockedWrites(t, n, "10.0.0.5:53", 0)
+	if drops := n.Stats().Drops; len(drops) != 0 {
+		t.Fatalf("expected no drops, got %v", drops)
+	}
+
+	// the conns are still usable
+	writeToAsync(sender, "world", "10.0.0.1:53")
+	mustRead(t, readers[0], "world")
+	writeToAsync(sender, "again", "10.0.0.5:53")
+	mustRead(t, receiver, "again")
+}
+
+func TestCancelAllPendingDefaultError(t *testing.T) {
+	n := newTestNetwork(t)
+	conn := newTestConn(t, n, "10.0.0.1:53", "")
+	readch := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadFrom(make([]byte, 64))
+		readch <- err
+	}()
+	waitBlockedReads(t, n, "10.0.0.1:53", 1)
+	n.CancelAllPending(nil)
+	if err := <-readch; !errors.Is(err, syscall.ENETRESET) {
+		t.Fatalf("expected ENETRESET, got %v", err)
+	}
+}
+
+func TestCancelAllPendingHonorsAckDelay(t *testing.T) {
+	n := newTestNetwork(t)
+	const delay = 100 * time.Millisecond
+	n.SetAckDelay(delay)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "")
+	newTestConn(t, n, "10.0.0.2:53", "")
+	writech := writeToAsync(sender, "hello", "10.0.0.2:53")
+	waitBlockedWrites(t, n, "10.0.0.2:53", 1)
+
+	// the failed write returns after the delay like any completed write
+	start := time.Now()
+	n.CancelAllPending(nil)
+	if err := <-writech; !errors.Is(err, syscall.ENETRESET) {
+		t.Fatalf("expected ENETRESET, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Fatalf("expected the write to return after %v, got %v", delay, elapsed)
+	}
+}
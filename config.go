@@ -0,0 +1,102 @@
+package netemlite
+
+//
+// Network configuration
+//
+
+import (
+	"math/rand"
+	"net/netip"
+	"time"
+)
+
+// NetworkConfig contains the whole configuration of a [Network], which allows
+// declaring the simulated environment using a single struct literal. The zero
+// value of each field means that the corresponding setting uses its default.
+type NetworkConfig struct {
+	// AckDelay is the OPTIONAL value to pass to SetAckDelay.
+	AckDelay time.Duration
+
+	// AddressAllocator is the OPTIONAL value to pass to SetAddressAllocator.
+	AddressAllocator AddressAllocator
+
+	// BatchProcessing is the OPTIONAL value to pass to SetBatchProcessing.
+	BatchProcessing int
+
+	// BindDelay is the OPTIONAL value to pass to SetBindDelay.
+	BindDelay time.Duration
+
+	// BindFaultInjector is the OPTIONAL value to pass to SetBindFaultInjector.
+	BindFaultInjector func(addr netip.AddrPort) error
+
+	// Blackholes contains the OPTIONAL prefixes to pass to AddBlackhole.
+	Blackholes []netip.Prefix
+
+	// DefaultReadTimeout is the OPTIONAL read timeout to pass to SetDefaultDeadlines.
+	DefaultReadTimeout time.Duration
+
+	// DefaultWriteTimeout is the OPTIONAL write timeout to pass to SetDefaultDeadlines.
+	DefaultWriteTimeout time.Duration
+
+	// ECNThreshold is the OPTIONAL value to pass to SetECNThreshold.
+	ECNThreshold int
+
+	// ICMPErrors is the OPTIONAL value to pass to SetICMPErrors.
+	ICMPErrors bool
+
+	// MTU is the OPTIONAL value to pass to SetMTU.
+	MTU int
+
+	// MaxConns is the OPTIONAL value to pass to SetMaxConns.
+	MaxConns int
+
+	// Partitions contains the OPTIONAL pairs of prefixes to pass to SetPartition.
+	Partitions [][2]netip.Prefix
+
+	// PayloadRewriter is the OPTIONAL value to pass to SetPayloadRewriter.
+	PayloadRewriter func(pkt CapturedPacket) []byte
+
+	// PriorityQueues is the OPTIONAL value to pass to SetPriorityQueues.
+	PriorityQueues map[byte]int
+
+	// RandomSource is the OPTIONAL value to pass to SetRandomSource.
+	RandomSource rand.Source
+
+	// RecordDeliveryLog is the OPTIONAL value to pass to RecordDeliveryLog.
+	RecordDeliveryLog bool
+
+	// ReversePathFilter is the OPTIONAL value to pass to SetReversePathFilter.
+	ReversePathFilter bool
+
+	// SpuriousWakeups is the OPTIONAL value to pass to SetSpuriousWakeups.
+	SpuriousWakeups float64
+}
+
+// NewNetworkWithConfig is like [NewNetwork] but also applies the given config. You
+// can still change the configuration at runtime using the [Network] setters.
+func NewNetworkWithConfig(cfg NetworkConfig) *Network {
+	n := NewNetwork()
+	n.SetAckDelay(cfg.AckDelay)
+	n.SetAddressAllocator(cfg.AddressAllocator)
+	n.SetBatchProcessing(cfg.BatchProcessing)
+	n.SetBindDelay(cfg.BindDelay)
+	n.SetBindFaultInjector(cfg.BindFaultInjector)
+	for _, prefix := range cfg.Blackholes {
+		n.AddBlackhole(prefix)
+	}
+	n.SetDefaultDeadlines(cfg.DefaultReadTimeout, cfg.DefaultWriteTimeout)
+	n.SetECNThreshold(cfg.ECNThreshold)
+	n.SetICMPErrors(cfg.ICMPErrors)
+	n.SetMaxConns(cfg.MaxConns)
+	n.SetMTU(cfg.MTU)
+	for _, partition := range cfg.Partitions {
+		n.SetPartition(partition[0], partition[1])
+	}
+	n.SetPayloadRewriter(cfg.PayloadRewriter)
+	n.SetPriorityQueues(cfg.PriorityQueues)
+	n.SetRandomSource(cfg.RandomSource)
+	n.RecordDeliveryLog(cfg.RecordDeliveryLog)
+	n.SetReversePathFilter(cfg.ReversePathFilter)
+	n.SetSpuriousWakeups(cfg.SpuriousWakeups)
+	return n
+}
@@ -0,0 +1,41 @@
+package netemlite
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestNewNetworkWithConfig(t *testing.T) {
+	n := NewNetworkWithConfig(NetworkConfig{
+		Blackholes:          []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		DefaultReadTimeout:  time.Second,
+		DefaultWriteTimeout: 2 * time.Second,
+		ICMPErrors:          true,
+		MaxConns:            10,
+		MTU:                 1280,
+		ReversePathFilter:   true,
+	})
+	defer n.Close()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.blackholes) != 1 || n.blackholes[0] != netip.MustParsePrefix("10.0.0.0/8") {
+		t.Fatal("unexpected blackholes", n.blackholes)
+	}
+	if n.defaultReadTimeout != time.Second || n.defaultWriteTimeout != 2*time.Second {
+		t.Fatal("unexpected default deadlines", n.defaultReadTimeout, n.defaultWriteTimeout)
+	}
+	if !n.icmpErrors || n.maxConns != 10 || n.mtu != 1280 || !n.reversePathFilter {
+		t.Fatal("unexpected config", n.icmpErrors, n.maxConns, n.mtu, n.reversePathFilter)
+	}
+}
+
+func TestNewNetworkWithZeroConfig(t *testing.T) {
+	n := NewNetworkWithConfig(NetworkConfig{})
+	defer n.Close()
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+	writeAsync(sender, "hello")
+	mustRead(t, receiver, "hello")
+}
@@ -0,0 +1,36 @@
+package netemlite
+
+//
+// Context-scoped conns
+//
+
+import (
+	"context"
+	"net/netip"
+)
+
+// NewUDPConnWithContext is like [NewUDPConn] but ties the conn to the given context,
+// such that canceling the context closes the conn, which interrupts all pending I/O
+// with [net.ErrClosed]. The goroutine watching the context exits when either the
+// context is done or the conn is closed, so closing the conn does not leak it.
+func NewUDPConnWithContext(ctx context.Context, network *Network, localAddr, peerAddr netip.AddrPort) (*UDPConn, error) {
+	// refuse to create a conn that would be immediately closed
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	conn, err := NewUDPConn(network, localAddr, peerAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-conn.closed:
+			// nothing
+		}
+	}()
+	return conn, nil
+}
@@ -0,0 +1,75 @@
+package netemlite
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// waitGoroutines waits until there are at most the given number of goroutines.
+func waitGoroutines(t *testing.T, count int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > count; {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines leaked: expected %d, got %d", count, runtime.NumGoroutine())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestNewUDPConnWithContextCancel(t *testing.T) {
+	n := newTestNetwork(t)
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn, err := NewUDPConnWithContext(ctx, n, netip.MustParseAddrPort("10.0.0.1:1234"), netip.AddrPort{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// canceling the context interrupts the pending read and closes the conn
+	errch := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadFrom(make([]byte, 64))
+		errch <- err
+	}()
+	waitBlockedReads(t, n, "10.0.0.1:1234", 1)
+	cancel()
+	if err := <-errch; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+
+	// the closed conn has released its address
+	newTestConn(t, n, "10.0.0.1:1234", "")
+	waitGoroutines(t, before)
+}
+
+func TestNewUDPConnWithContextClose(t *testing.T) {
+	n := newTestNetwork(t)
+	before := runtime.NumGoroutine()
+	conn, err := NewUDPConnWithContext(context.Background(), n, netip.MustParseAddrPort("10.0.0.1:1234"), netip.AddrPort{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// closing the conn stops the goroutine watching a context that is never done
+	conn.Close()
+	waitGoroutines(t, before)
+}
+
+func TestNewUDPConnWithContextAlreadyDone(t *testing.T) {
+	n := newTestNetwork(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := NewUDPConnWithContext(ctx, n, netip.MustParseAddrPort("10.0.0.1:1234"), netip.AddrPort{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected Canceled, got %v", err)
+	}
+
+	// the address is still available
+	newTestConn(t, n, "10.0.0.1:1234", "")
+}
@@ -0,0 +1,40 @@
+package netemlite
+
+//
+// Delivery log
+//
+
+import "net/netip"
+
+// RecordDeliveryLog controls whether the network records, for each destination
+// address, the sequence numbers of the datagrams it delivers, in delivery order,
+// which allows asserting on the exact delivery order. Use DeliveryLog to obtain
+// the recorded sequence numbers. Enabling recording clears the log and disabling
+// it discards the log.
+func (n *Network) RecordDeliveryLog(enabled bool) {
+	n.mu.Lock()
+	n.deliveryLog = nil
+	if enabled {
+		n.deliveryLog = map[netip.AddrPort][]uint64{}
+	}
+	n.mu.Unlock()
+}
+
+// DeliveryLog returns a copy of the sequence numbers of the datagrams delivered to
+// the given destination address, in delivery order, which is the address used by
+// the senders and may differ from the address to which the receiver is bound. The
+// return value is empty unless you enabled recording using RecordDeliveryLog.
+func (n *Network) DeliveryLog(dst netip.AddrPort) []uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]uint64{}, n.deliveryLog[dst]...)
+}
+
+// logDelivery records the delivery of the given write, if needed.
+func (n *Network) logDelivery(write *networkWriteUDP) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.deliveryLog != nil {
+		n.deliveryLog[write.destAddr] = append(n.deliveryLog[write.destAddr], write.seq)
+	}
+}
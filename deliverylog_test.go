@@ -0,0 +1,98 @@
+package netemlite
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"syscall"
+	"testing"
+)
+
+// mustReadSeq reads a datagram using ReadFromSeq and returns its sequence
+// number, failing the test if the payload differs from the expected one.
+func mustReadSeq(t *testing.T, conn *UDPConn, expect string) uint64 {
+	t.Helper()
+	buffer := make([]byte, 64)
+	count, _, seq, err := conn.ReadFromSeq(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buffer[:count]); got != expect {
+		t.Fatalf("expected %q, got %q", expect, got)
+	}
+	return seq
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	n := newTestNetwork(t)
+	n.RecordDeliveryLog(true)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "")
+	first := newTestConn(t, n, "10.0.0.2:53", "")
+	second := newTestConn(t, n, "10.0.0.3:53", "")
+
+	// interleave the datagrams sent to the two receivers
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "a")
+	queueDatagrams(t, n, sender, "10.0.0.3:53", "b")
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "c")
+
+	// read out of order with respect to sending
+	seqs := []uint64{
+		mustReadSeq(t, second, "b"),
+		mustReadSeq(t, first, "a"),
+		mustReadSeq(t, first, "c"),
+	}
+	if fmt.Sprint(seqs) != "[2 1 3]" {
+		t.Fatalf("unexpected sequence numbers %v", seqs)
+	}
+	if log := n.DeliveryLog(netip.MustParseAddrPort("10.0.0.2:53")); fmt.Sprint(log) != "[1 3]" {
+		t.Fatalf("unexpected delivery log %v", log)
+	}
+	if log := n.DeliveryLog(netip.MustParseAddrPort("10.0.0.3:53")); fmt.Sprint(log) != "[2]" {
+		t.Fatalf("unexpected delivery log %v", log)
+	}
+}
+
+func TestDeliveryLogDisabled(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "a")
+	mustReadSeq(t, receiver, "a")
+	if log := n.DeliveryLog(netip.MustParseAddrPort("10.0.0.2:53")); len(log) != 0 {
+		t.Fatalf("expected an empty log, got %v", log)
+	}
+}
+
+func TestReadFromSeqConnected(t *testing.T) {
+	n := newTestNetwork(t)
+	conn := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	if _, _, _, err := conn.ReadFromSeq(make([]byte, 64)); !errors.Is(err, syscall.EISCONN) {
+		t.Fatalf("expected EISCONN, got %v", err)
+	}
+}
+
+func TestDeliveryLogRecordsReordering(t *testing.T) {
+	n := newTestNetwork(t)
+	n.RecordDeliveryLog(true)
+	const dscpEF = 46
+	n.SetPriorityQueues(map[byte]int{dscpEF: 3})
+	low := newTestConn(t, n, "10.0.0.1:1234", "")
+	high := newTestConn(t, n, "10.0.0.3:1234", "")
+	high.SetTOS(dscpEF << 2)
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+
+	// the high priority datagram sent last is delivered first
+	queueDatagrams(t, n, low, "10.0.0.2:53", "l0", "l1")
+	queueDatagrams(t, n, high, "10.0.0.2:53", "h0")
+	readAll(t, receiver, 3)
+	if log := n.DeliveryLog(netip.MustParseAddrPort("10.0.0.2:53")); fmt.Sprint(log) != "[3 1 2]" {
+		t.Fatalf("unexpected delivery log %v", log)
+	}
+
+	// disabling and enabling recording clears the log
+	n.RecordDeliveryLog(false)
+	n.RecordDeliveryLog(true)
+	if log := n.DeliveryLog(netip.MustParseAddrPort("10.0.0.2:53")); len(log) != 0 {
+		t.Fatalf("expected an empty log, got %v", log)
+	}
+}
@@ -0,0 +1,70 @@
+package netemlite
+
+//
+// Dialing with retries
+//
+
+import (
+	"context"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// dialRetryInitialBackoff is the backoff before the first retry.
+const dialRetryInitialBackoff = 10 * time.Millisecond
+
+// DialUDPWithRetry is like [Network.Dial] but, if ICMP errors are enabled (see
+// [Network.SetICMPErrors]), checks whether the peer is bound and, if not, retries
+// using a fresh ephemeral port after an exponential backoff, until it has made the
+// given number of attempts, failing with [syscall.ECONNREFUSED], or the context is
+// done.
+func (n *Network) DialUDPWithRetry(ctx context.Context, peer netip.AddrPort, attempts int) (*UDPConn, error) {
+	localAddr := unspecifiedAddrPort(peer)
+	backoff := dialRetryInitialBackoff
+	err := error(syscall.EINVAL)
+
+	for attempt := 0; attempt < attempts; attempt++ {
+		// wait before retrying
+		if attempt > 0 {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, ctx.Err()
+			case <-timer.C:
+			}
+			backoff *= 2
+		}
+
+		// attempt to dial
+		var conn *UDPConn
+		conn, err = n.dialUDP(localAddr, peer)
+		if err == nil {
+			return conn, nil
+		}
+		if err != syscall.ECONNREFUSED {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// dialUDP creates a conn connected to the given peer and fails with
+// [syscall.ECONNREFUSED] if ICMP errors are enabled and the peer is not
+// reachable.
+func (n *Network) dialUDP(localAddr, peer netip.AddrPort) (*UDPConn, error) {
+	conn, err := NewUDPConn(n, localAddr, peer)
+	if err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	icmpErrors := n.icmpErrors
+	n.mu.Unlock()
+	if icmpErrors && !n.isRoutable(peer) {
+		conn.Close()
+		return nil, syscall.ECONNREFUSED
+	}
+	return conn, nil
+}
@@ -0,0 +1,83 @@
+package netemlite
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDialUDPWithRetry(t *testing.T) {
+	n := newTestNetwork(t)
+	n.SetICMPErrors(true)
+	peer := netip.MustParseAddrPort("10.0.0.2:53")
+
+	// count the binds of the dialer, which use an ephemeral port
+	binds := make(chan netip.AddrPort, 64)
+	n.SetBindFaultInjector(func(addr netip.AddrPort) error {
+		if addr != peer {
+			binds <- addr
+		}
+		return nil
+	})
+
+	type result struct {
+		conn *UDPConn
+		err  error
+	}
+	resch := make(chan result, 1)
+	go func() {
+		conn, err := n.DialUDPWithRetry(context.Background(), peer, 10)
+		resch <- result{conn, err}
+	}()
+
+	// bring up the peer only once the second attempt has started, so that
+	// at least the first attempt fails
+	first, second := <-binds, <-binds
+	if first == second {
+		t.Fatal("expected a fresh ephemeral port", first, second)
+	}
+	newTestConn(t, n, "10.0.0.2:53", "")
+	res := <-resch
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	defer res.conn.Close()
+	if res.conn.RemoteAddr().String() != "10.0.0.2:53" {
+		t.Fatal("unexpected peer", res.conn.RemoteAddr())
+	}
+}
+
+func TestDialUDPWithRetryGivesUp(t *testing.T) {
+	n := newTestNetwork(t)
+	n.SetICMPErrors(true)
+	if _, err := n.DialUDPWithRetry(context.Background(), netip.MustParseAddrPort("10.0.0.2:53"), 2); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("expected ECONNREFUSED, got %v", err)
+	}
+
+	// the failed attempts do not leave conns behind
+	if conns := n.Dump().Conns; len(conns) != 0 {
+		t.Fatalf("expected no conns, got %v", conns)
+	}
+}
+
+func TestDialUDPWithRetryContextCanceled(t *testing.T) {
+	n := newTestNetwork(t)
+	n.SetICMPErrors(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Millisecond)
+	defer cancel()
+	if _, err := n.DialUDPWithRetry(ctx, netip.MustParseAddrPort("10.0.0.2:53"), 100); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestDialUDPWithRetryWithoutICMPErrors(t *testing.T) {
+	n := newTestNetwork(t)
+	conn, err := n.DialUDPWithRetry(context.Background(), netip.MustParseAddrPort("10.0.0.2:53"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,128 @@
+package netemlite
+
+//
+// Waiting for queued datagrams to be delivered
+//
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ErrUndelivered indicates that some datagrams were still waiting to be
+// delivered when [Network.CloseWithTimeout] closed the network.
+var ErrUndelivered = errors.New("netemlite: some datagrams were not delivered")
+
+// networkWaitDrained is a request to wait until no datagrams are queued.
+type networkWaitDrained struct {
+	// ack is closed by the Network layer when there are no queued datagrams.
+	ack chan any
+}
+
+// WaitDrained blocks until no datagram is waiting to be delivered anywhere in the
+// network, so that tests can make their final assertions after the traffic has
+// settled. We ignore the datagrams queued for the orphan conns created by
+// [Network.RestoreState], which have no reader until a new conn takes them over.
+// This method returns the context error if the context is done before that and
+// [net.ErrClosed] if the network is closed.
+func (n *Network) WaitDrained(ctx context.Context) error {
+	req := &networkWaitDrained{
+		ack: make(chan any),
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+
+	case <-n.closed:
+		return net.ErrClosed
+
+	case n.waitDrained <- req:
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-n.closed:
+			return net.ErrClosed
+
+		case <-req.ack:
+			return nil
+		}
+	}
+}
+
+// CloseWithTimeout gracefully closes the network. It stops accepting new conns
+// and new datagrams, which fail with [net.ErrClosed], but keeps delivering the
+// datagrams already queued for up to the given timeout. Then, it closes the
+// network and returns [ErrUndelivered] if some datagrams were not delivered.
+func (n *Network) CloseWithTimeout(timeout time.Duration) error {
+	// stop accepting new conns and datagrams
+	n.mu.Lock()
+	n.draining = true
+	n.mu.Unlock()
+
+	// wait for queued datagrams to be delivered
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := n.WaitDrained(ctx)
+
+	// terminate the background goroutine
+	n.Close()
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrUndelivered
+	}
+	return nil
+}
+
+// isDraining returns whether we are gracefully closing the network.
+func (n *Network) isDraining() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.draining
+}
+
+// onWaitDrained handles a request to wait until no datagrams are queued.
+func (n *Network) onWaitDrained(req *networkWaitDrained) {
+	n.drainWaiters = append(n.drainWaiters, req)
+	n.maybeNotifyDrained()
+}
+
+// maybeNotifyDrained unblocks the drain waiters if no datagrams are queued
+// for conns other than orphan conns.
+func (n *Network) maybeNotifyDrained() {
+	if len(n.drainWaiters) <= 0 {
+		return
+	}
+	for _, state := range n.udp {
+		if !state.orphan && len(state.blockedWrites) > 0 {
+			return
+		}
+	}
+	for _, req := range n.drainWaiters {
+		close(req.ack)
+	}
+	n.drainWaiters = nil
+}
+
+// AssertDrained returns an error wrapping [ErrUndelivered] that lists the conns
+// with datagrams waiting to be read or with blocked reads, which helps catching
+// tests that forget to consume traffic, or nil if there are no such conns. This
+// method uses [Network.Dump], so it returns nil if the network is closed.
+func (n *Network) AssertDrained() error {
+	var problems []string
+	for _, conn := range n.Dump().Conns {
+		if conn.BlockedWrites > 0 || conn.BlockedReads > 0 {
+			problems = append(problems, fmt.Sprintf(
+				"%s: %d queued datagram(s), %d blocked read(s)",
+				conn.LocalAddr, conn.BlockedWrites, conn.BlockedReads,
+			))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrUndelivered, strings.Join(problems, "; "))
+	}
+	return nil
+}
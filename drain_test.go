@@ -0,0 +1,172 @@
+package netemlite
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitDraining waits until CloseWithTimeout has started draining the network.
+func waitDraining(t *testing.T, n *Network) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if n.isDraining() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("timed out waiting for the network to drain")
+}
+
+func TestCloseWithTimeoutDeliversQueuedDatagrams(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "first", "second")
+
+	errch := make(chan error, 1)
+	go func() {
+		errch <- n.CloseWithTimeout(5 * time.Second)
+	}()
+	waitDraining(t, n)
+
+	// new datagrams are refused while draining
+	if _, err := receiver.Write([]byte("refused")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+
+	// the queued datagrams are still delivered
+	mustRead(t, receiver, "first")
+	mustRead(t, receiver, "second")
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-n.closed:
+	default:
+		t.Fatal("expected the network to be closed")
+	}
+}
+
+func TestCloseWithTimeoutUndelivered(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "never read")
+	if err := n.CloseWithTimeout(10 * time.Millisecond); !errors.Is(err, ErrUndelivered) {
+		t.Fatalf("expected ErrUndelivered, got %v", err)
+	}
+}
+
+func TestCloseWithTimeoutRefusesNewConns(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "hello")
+	errch := make(chan error, 1)
+	go func() {
+		errch <- n.CloseWithTimeout(5 * time.Second)
+	}()
+	waitDraining(t, n)
+	if _, err := NewUDPConn(n, netip.MustParseAddrPort("10.0.0.3:53"), netip.AddrPort{}); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	mustRead(t, receiver, "hello")
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitDrained(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "first", "second")
+
+	errch := make(chan error, 1)
+	go func() {
+		errch <- n.WaitDrained(context.Background())
+	}()
+
+	// we should still be waiting because nobody read the datagrams
+	mustRead(t, receiver, "first")
+	select {
+	case err := <-errch:
+		t.Fatalf("unexpected early return: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	mustRead(t, receiver, "second")
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWaitDrainedContextCanceled(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "never read")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := n.WaitDrained(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestWaitDrainedIgnoresOrphanConns(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "orphaned")
+	state := n.SaveState()
+
+	// closing the receiver and restoring creates an orphan conn with a queued datagram
+	receiver.Close()
+	if err := n.RestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	waitBlockedWrites(t, n, "10.0.0.2:53", 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := n.WaitDrained(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAssertDrained(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	if err := n.AssertDrained(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a datagram nobody read is reported
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "leaked")
+	err := n.AssertDrained()
+	if !errors.Is(err, ErrUndelivered) || !strings.Contains(err.Error(), "10.0.0.2:53: 1 queued datagram(s)") {
+		t.Fatalf("expected ErrUndelivered for the receiver, got %v", err)
+	}
+
+	// the network is drained after reading it
+	mustRead(t, receiver, "leaked")
+	if err := n.AssertDrained(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAssertDrainedBlockedRead(t *testing.T) {
+	n := newTestNetwork(t)
+	conn := newTestConn(t, n, "10.0.0.1:1234", "")
+	go conn.ReadFrom(make([]byte, 64))
+	waitBlockedReads(t, n, "10.0.0.1:1234", 1)
+	err := n.AssertDrained()
+	if !errors.Is(err, ErrUndelivered) || !strings.Contains(err.Error(), "1 blocked read(s)") {
+		t.Fatalf("expected ErrUndelivered for the blocked read, got %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package netemlite
+
+//
+// Reasons for dropping datagrams
+//
+
+// DropReason explains why the [Network] dropped a datagram.
+type DropReason int
+
+const (
+	// dropReasonNone indicates that the datagram was not dropped.
+	dropReasonNone = DropReason(iota)
+
+	// DropReasonNoSuchConn indicates that no conn was bound to the
+	// destination address of the datagram.
+	DropReasonNoSuchConn
+
+	// DropReasonBlackhole indicates that the destination address of the
+	// datagram belongs to a blackholed prefix.
+	DropReasonBlackhole
+
+	// DropReasonPeerMismatch indicates that the destination conn is connected
+	// to a peer whose address differs from the source address of the datagram.
+	DropReasonPeerMismatch
+
+	// DropReasonConnClosed indicates that the destination conn was closed
+	// while the datagram was waiting to be read.
+	DropReasonConnClosed
+
+	// DropReasonMiddleware indicates that a middleware installed
+	// using [Network.Use] dropped the datagram.
+	DropReasonMiddleware
+
+	// DropReasonSpoofedSource indicates that the reverse path filter dropped
+	// a datagram whose source address does not belong to the sending conn.
+	DropReasonSpoofedSource
+
+	// DropReasonPartitioned indicates that the source and the destination
+	// addresses are on different sides of a partition.
+	DropReasonPartitioned
+
+	// DropReasonRewriter indicates that the payload rewriter installed using
+	// [Network.SetPayloadRewriter] dropped the datagram.
+	DropReasonRewriter
+)
+
+// String implements fmt.Stringer.
+func (r DropReason) String() string {
+	switch r {
+	case dropReasonNone:
+		return "none"
+	case DropReasonNoSuchConn:
+		return "no_such_conn"
+	case DropReasonBlackhole:
+		return "blackhole"
+	case DropReasonPeerMismatch:
+		return "peer_mismatch"
+	case DropReasonConnClosed:
+		return "conn_closed"
+	case DropReasonMiddleware:
+		return "middleware"
+	case DropReasonSpoofedSource:
+		return "spoofed_source"
+	case DropReasonPartitioned:
+		return "partitioned"
+	case DropReasonRewriter:
+		return "rewriter"
+	default:
+		return "unknown"
+	}
+}
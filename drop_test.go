@@ -0,0 +1,141 @@
+package netemlite
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+func TestWriteErrorObserver(t *testing.T) {
+	n := newTestNetwork(t)
+	n.AddBlackhole(netip.MustParsePrefix("10.0.0.0/24"))
+	conn := newTestConn(t, n, "10.0.1.1:1234", "")
+
+	type drop struct {
+		size   int
+		dest   netip.AddrPort
+		reason DropReason
+	}
+	var (
+		drops []drop
+		mu    sync.Mutex
+	)
+	conn.SetWriteErrorObserver(func(payloadLen int, dst netip.AddrPort, reason DropReason) {
+		mu.Lock()
+		drops = append(drops, drop{payloadLen, dst, reason})
+		mu.Unlock()
+	})
+
+	// every send to the blackholed prefix is lost but succeeds
+	var expect []drop
+	for idx := 1; idx <= 4; idx++ {
+		dest := netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(idx)}), 53)
+		count, err := conn.WriteTo(make([]byte, idx*10), net.UDPAddrFromAddrPort(dest))
+		if err != nil || count != idx*10 {
+			t.Fatal(count, err)
+		}
+		expect = append(expect, drop{idx * 10, dest, DropReasonBlackhole})
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(drops) != len(expect) {
+		t.Fatalf("expected %d drops, got %d", len(expect), len(drops))
+	}
+	for idx := range expect {
+		if drops[idx] != expect[idx] {
+			t.Fatalf("drop %d: expected %+v, got %+v", idx, expect[idx], drops[idx])
+		}
+	}
+}
+
+func TestWriteErrorObserverNotCalledOnDelivery(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+	called := false
+	sender.SetWriteErrorObserver(func(int, netip.AddrPort, DropReason) {
+		called = true
+	})
+	errch := writeAsync(sender, "hello")
+	mustRead(t, receiver, "hello")
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+	if called {
+		t.Fatal("observer called for a delivered datagram")
+	}
+}
+
+func TestDropReasonString(t *testing.T) {
+	for reason, expect := range map[DropReason]string{
+		dropReasonNone:          "none",
+		DropReasonNoSuchConn:    "no_such_conn",
+		DropReasonBlackhole:     "blackhole",
+		DropReasonPeerMismatch:  "peer_mismatch",
+		DropReasonConnClosed:    "conn_closed",
+		DropReasonMiddleware:    "middleware",
+		DropReasonSpoofedSource: "spoofed_source",
+		DropReasonPartitioned:   "partitioned",
+		DropReasonRewriter:      "rewriter",
+		DropReason(1000):        "unknown",
+	} {
+		if got := reason.String(); got != expect {
+			t.Fatalf("%d: expected %q, got %q", reason, expect, got)
+		}
+	}
+}
+
+func TestStatsDropsByReason(t *testing.T) {
+	n := newTestNetwork(t)
+	n.AddBlackhole(netip.MustParsePrefix("192.168.0.0/16"))
+	sender := newTestConn(t, n, "10.0.0.1:1234", "")
+	newTestConn(t, n, "10.0.0.2:53", "10.0.0.3:53")
+
+	// the writes return immediately because all the datagrams are dropped
+	writes := []struct {
+		dest  string
+		count int
+	}{
+		{dest: "192.168.1.1:53", count: 1},
+		{dest: "10.0.0.9:53", count: 2},
+		{dest: "10.0.0.2:53", count: 3},
+	}
+	for _, write := range writes {
+		for idx := 0; idx < write.count; idx++ {
+			if err := <-writeToAsync(sender, "hello", write.dest); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	stats := n.Stats()
+	expect := map[DropReason]uint64{
+		DropReasonBlackhole:    1,
+		DropReasonNoSuchConn:   2,
+		DropReasonPeerMismatch: 3,
+	}
+	if len(stats.Drops) != len(expect) {
+		t.Fatalf("expected %v, got %v", expect, stats.Drops)
+	}
+	for reason, count := range expect {
+		if stats.Drops[reason] != count {
+			t.Fatalf("%s: expected %d, got %d", reason, count, stats.Drops[reason])
+		}
+	}
+
+	// the returned map is a copy
+	stats.Drops[DropReasonBlackhole] = 100
+	if drops := n.Stats().Drops[DropReasonBlackhole]; drops != 1 {
+		t.Fatalf("expected 1, got %d", drops)
+	}
+}
+
+func TestStatsClosedNetwork(t *testing.T) {
+	n := NewNetwork()
+	n.Close()
+	if stats := n.Stats(); len(stats.Drops) != 0 {
+		t.Fatalf("expected empty stats, got %v", stats)
+	}
+}
@@ -0,0 +1,112 @@
+package netemlite
+
+//
+// Inspecting the network state
+//
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+)
+
+// NetworkSnapshot is a snapshot of the state of a [Network].
+type NetworkSnapshot struct {
+	// Conns contains a snapshot of each conn sorted by local address.
+	Conns []ConnSnapshot
+}
+
+// ConnSnapshot is a snapshot of the state of a conn.
+type ConnSnapshot struct {
+	// BlockedReads is the number of reads waiting for a datagram.
+	BlockedReads int
+
+	// BlockedWrites is the number of datagrams waiting for a read.
+	BlockedWrites int
+
+	// BufferedBytes is the number of bytes of the datagrams waiting for a read.
+	BufferedBytes int
+
+	// LocalAddr is the local address of the conn.
+	LocalAddr netip.AddrPort
+
+	// PeerAddr is the peer address of a connected conn or the zero value.
+	PeerAddr netip.AddrPort
+}
+
+// networkDump is a request to snapshot the network state.
+type networkDump struct {
+	// ack is closed by the Network layer to acknowledge that
+	// it has processed this message.
+	ack chan any
+
+	// snapshot is the snapshot set by the Network layer.
+	snapshot NetworkSnapshot
+}
+
+// Dump returns a snapshot of the state of each conn, gathered atomically by
+// the background goroutine, which is useful to diagnose a test that hangs. The
+// returned snapshot is empty if the network has been closed.
+func (n *Network) Dump() NetworkSnapshot {
+	req := &networkDump{
+		ack:      make(chan any),
+		snapshot: NetworkSnapshot{},
+	}
+	select {
+	case <-n.closed:
+		return NetworkSnapshot{}
+
+	case n.dump <- req:
+		select {
+		case <-n.closed:
+			return NetworkSnapshot{}
+
+		case <-req.ack:
+			return req.snapshot
+		}
+	}
+}
+
+// PendingReads returns the number of reads currently blocked waiting for a
+// datagram to arrive on this conn, which is useful to ensure that a given number
+// of goroutines are actually blocked inside Read or ReadFrom.
+func (c *UDPConn) PendingReads() (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	localAddr := c.getLocalAddr()
+	for _, conn := range c.network.Dump().Conns {
+		if conn.LocalAddr == localAddr {
+			return conn.BlockedReads, nil
+		}
+	}
+	return 0, net.ErrClosed
+}
+
+// onDump handles a request to snapshot the network state.
+func (n *Network) onDump(req *networkDump) {
+	// always acknowledge the caller
+	defer close(req.ack)
+
+	// collect the state of each conn
+	for addr, state := range n.udp {
+		conn := ConnSnapshot{
+			BlockedReads:  len(state.blockedReads),
+			BlockedWrites: len(state.blockedWrites),
+			BufferedBytes: 0,
+			LocalAddr:     addr,
+			PeerAddr:      state.peerAddr,
+		}
+		for _, write := range state.blockedWrites {
+			conn.BufferedBytes += len(write.payload)
+		}
+		req.snapshot.Conns = append(req.snapshot.Conns, conn)
+	}
+
+	// make the snapshot deterministic
+	sort.Slice(req.snapshot.Conns, func(i, j int) bool {
+		return req.snapshot.Conns[i].LocalAddr.Compare(req.snapshot.Conns[j].LocalAddr) < 0
+	})
+}
@@ -0,0 +1,82 @@
+package netemlite
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestDump(t *testing.T) {
+	n := newTestNetwork(t)
+	newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	queueDatagrams(t, n, receiver, "10.0.0.1:1234", "abc", "defgh")
+
+	// strand a read on the receiver, which has nothing to read
+	go receiver.Read(make([]byte, 64))
+	waitBlockedReads(t, n, "10.0.0.2:53", 1)
+
+	snapshot := n.Dump()
+	if len(snapshot.Conns) != 2 {
+		t.Fatalf("expected 2 conns, got %d", len(snapshot.Conns))
+	}
+	expect := []ConnSnapshot{{
+		BlockedReads:  0,
+		BlockedWrites: 2,
+		BufferedBytes: 8,
+		LocalAddr:     netip.MustParseAddrPort("10.0.0.1:1234"),
+		PeerAddr:      netip.MustParseAddrPort("10.0.0.2:53"),
+	}, {
+		BlockedReads:  1,
+		BlockedWrites: 0,
+		BufferedBytes: 0,
+		LocalAddr:     netip.MustParseAddrPort("10.0.0.2:53"),
+		PeerAddr:      netip.MustParseAddrPort("10.0.0.1:1234"),
+	}}
+	for idx, conn := range snapshot.Conns {
+		if conn != expect[idx] {
+			t.Fatalf("conn %d: expected %+v, got %+v", idx, expect[idx], conn)
+		}
+	}
+}
+
+func TestDumpClosedNetwork(t *testing.T) {
+	n := NewNetwork()
+	n.Close()
+	if snapshot := n.Dump(); len(snapshot.Conns) != 0 {
+		t.Fatalf("expected an empty snapshot, got %+v", snapshot)
+	}
+}
+
+func TestPendingReads(t *testing.T) {
+	n := newTestNetwork(t)
+	conn := newTestConn(t, n, "10.0.0.2:53", "")
+	const count = 4
+	for idx := 0; idx < count; idx++ {
+		go conn.ReadFrom(make([]byte, 64))
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		pending, err := conn.PendingReads()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pending == count {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d pending reads, got %d", count, pending)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPendingReadsClosedConn(t *testing.T) {
+	n := newTestNetwork(t)
+	conn := newTestConn(t, n, "10.0.0.2:53", "")
+	conn.Close()
+	if _, err := conn.PendingReads(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
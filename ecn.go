@@ -0,0 +1,62 @@
+package netemlite
+
+//
+// Explicit Congestion Notification (aka ECN)
+//
+
+// The ECN codepoints, which are the two least significant bits of the ToS byte.
+const (
+	// ECNNotECT indicates a datagram that is not ECN-capable.
+	ECNNotECT = byte(0b00)
+
+	// ECNECT1 indicates an ECN-capable datagram using ECT(1).
+	ECNECT1 = byte(0b01)
+
+	// ECNECT0 indicates an ECN-capable datagram using ECT(0).
+	ECNECT0 = byte(0b10)
+
+	// ECNCE indicates an ECN-capable datagram that experienced congestion.
+	ECNCE = byte(0b11)
+)
+
+// ecnMask is the mask to extract the ECN codepoint from the ToS byte.
+const ecnMask = byte(0b11)
+
+// SetECN controls whether the datagrams subsequently sent by this conn are ECN-capable
+// (i.e., use the [ECNECT0] codepoint), which overrides the ECN bits set using SetTOS.
+// The [Network] marks ECN-capable datagrams using the [ECNCE] codepoint when their
+// destination is congested (see [Network.SetECNThreshold]).
+func (c *UDPConn) SetECN(enabled bool) {
+	c.ecn.Store(enabled)
+}
+
+// getTOS returns the ToS byte of the datagrams we send.
+func (c *UDPConn) getTOS() byte {
+	tos := byte(c.tos.Load())
+	if c.ecn.Load() {
+		tos = tos&^ecnMask | ECNECT0
+	}
+	return tos
+}
+
+// SetECNThreshold sets the number of datagrams waiting to be read by a conn above
+// which the network considers the conn congested. In such a case, rather than
+// dropping, the network marks subsequent ECN-capable datagrams sent to the conn using
+// the [ECNCE] codepoint. A zero or negative value, which is the default, disables
+// marking. Datagrams that are not ECN-capable are never marked.
+func (n *Network) SetECNThreshold(threshold int) {
+	n.mu.Lock()
+	n.ecnThreshold = threshold
+	n.mu.Unlock()
+}
+
+// maybeMarkCongestion marks an ECN-capable write using the [ECNCE] codepoint
+// if the given conn is congested.
+func (n *Network) maybeMarkCongestion(dest *networkConnStateUDP, write *networkWriteUDP) {
+	n.mu.Lock()
+	threshold := n.ecnThreshold
+	n.mu.Unlock()
+	if threshold > 0 && write.tos&ecnMask != ECNNotECT && len(dest.blockedWrites) >= threshold {
+		write.tos |= ECNCE
+	}
+}
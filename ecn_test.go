@@ -0,0 +1,62 @@
+package netemlite
+
+import (
+	"fmt"
+	"testing"
+)
+
+// readECN reads the given number of datagrams and returns their ECN codepoints.
+func readECN(t *testing.T, conn *UDPConn, count int) (codepoints []byte) {
+	t.Helper()
+	buffer, oob := make([]byte, 64), make([]byte, 64)
+	for idx := 0; idx < count; idx++ {
+		_, oobn, _, _, err := conn.ReadMsgUDP(buffer, oob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ecn, found := ParseECNOOB(oob[:oobn])
+		if !found {
+			t.Fatal("missing ECN codepoint")
+		}
+		codepoints = append(codepoints, ecn)
+	}
+	return
+}
+
+func TestECNMarking(t *testing.T) {
+	n := newTestNetwork(t)
+	n.SetECNThreshold(2)
+	capable := newTestConn(t, n, "10.0.0.1:1234", "")
+	capable.SetECN(true)
+	legacy := newTestConn(t, n, "10.0.0.3:1234", "")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+	receiver.SetReceiveTOS(true)
+
+	// the datagrams queued once the receiver is congested are marked,
+	// unless they are not ECN-capable
+	queueDatagrams(t, n, capable, "10.0.0.2:53", "a", "b", "c")
+	queueDatagrams(t, n, legacy, "10.0.0.2:53", "d")
+	queueDatagrams(t, n, capable, "10.0.0.2:53", "e")
+	expect := fmt.Sprint([]byte{ECNECT0, ECNECT0, ECNCE, ECNNotECT, ECNCE})
+	if got := fmt.Sprint(readECN(t, receiver, 5)); got != expect {
+		t.Fatalf("expected %s, got %s", expect, got)
+	}
+
+	// the receiver is no longer congested after reading
+	queueDatagrams(t, n, capable, "10.0.0.2:53", "f")
+	if got := readECN(t, receiver, 1); got[0] != ECNECT0 {
+		t.Fatalf("expected ECT(0), got %d", got[0])
+	}
+}
+
+func TestECNMarkingDisabled(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "")
+	sender.SetECN(true)
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+	receiver.SetReceiveTOS(true)
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "a", "b", "c")
+	if got, expect := fmt.Sprint(readECN(t, receiver, 3)), fmt.Sprint([]byte{ECNECT0, ECNECT0, ECNECT0}); got != expect {
+		t.Fatalf("expected %s, got %s", expect, got)
+	}
+}
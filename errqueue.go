@@ -0,0 +1,60 @@
+package netemlite
+
+//
+// Reading asynchronous socket errors
+//
+
+import "net/netip"
+
+// networkReadErrorQueue is a request to pop the pending error of a conn.
+type networkReadErrorQueue struct {
+	// ack is closed by the Network layer to acknowledge that
+	// it has processed this message.
+	ack chan any
+
+	// err is the pending error set by the Network layer.
+	err error
+
+	// localAddr is the local address of the conn.
+	localAddr netip.AddrPort
+}
+
+// ReadErrorQueue pops the pending asynchronous error of this conn, such as an error
+// caused by a previous ICMP port unreachable (see [Network.SetICMPErrors]), without
+// reading any datagram, like recvmsg with MSG_ERRQUEUE. The ok return value is false
+// if there is no pending error or the conn is closed. Once popped, the error is not
+// reported by the next write anymore.
+func (c *UDPConn) ReadErrorQueue() (err error, ok bool) {
+	req := &networkReadErrorQueue{
+		ack:       make(chan any),
+		err:       nil,
+		localAddr: c.getLocalAddr(),
+	}
+	select {
+	case <-c.closed:
+		return nil, false
+
+	case <-c.network.closed:
+		return nil, false
+
+	case c.network.readErrorQueue <- req:
+		select {
+		case <-c.network.closed:
+			return nil, false
+
+		case <-req.ack:
+			return req.err, req.err != nil
+		}
+	}
+}
+
+// onReadErrorQueue handles a request to pop the pending error of a conn.
+func (n *Network) onReadErrorQueue(req *networkReadErrorQueue) {
+	// always acknowledge the caller
+	defer close(req.ack)
+
+	// pop the pending error, if any
+	if state := n.udp[req.localAddr]; state != nil {
+		req.err, state.pendingErr = state.pendingErr, nil
+	}
+}
@@ -0,0 +1,38 @@
+package netemlite
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestReadErrorQueue(t *testing.T) {
+	n := newTestNetwork(t)
+	n.SetICMPErrors(true)
+	conn := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	if err, ok := conn.ReadErrorQueue(); ok {
+		t.Fatalf("expected an empty queue, got %v", err)
+	}
+
+	// nobody is bound to the peer address, so we get a port unreachable
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok := conn.ReadErrorQueue(); !ok || !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("expected ECONNREFUSED, got %v and %v", err, ok)
+	}
+
+	// the error is gone, so it is not reported twice
+	if err, ok := conn.ReadErrorQueue(); ok {
+		t.Fatalf("expected an empty queue, got %v", err)
+	}
+}
+
+func TestReadErrorQueueClosedConn(t *testing.T) {
+	n := newTestNetwork(t)
+	conn := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	conn.Close()
+	if err, ok := conn.ReadErrorQueue(); ok || err != nil {
+		t.Fatalf("expected nil and false, got %v and %v", err, ok)
+	}
+}
@@ -0,0 +1,80 @@
+package netemlite
+
+//
+// Connected-peer source filter
+//
+
+import (
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// networkSetAcceptAnySource is a request to configure the source filter of a conn.
+type networkSetAcceptAnySource struct {
+	// ack is closed by the Network layer to acknowledge that
+	// it has processed this message.
+	ack chan any
+
+	// enabled indicates whether to accept datagrams from any source.
+	enabled bool
+
+	// err is the error set by the Network layer.
+	err error
+
+	// localAddr is the local address of the conn.
+	localAddr netip.AddrPort
+}
+
+// SetAcceptAnySource controls whether a connected conn receives datagrams sent
+// by any source rather than only by its peer, which is useful to observe stray
+// datagrams for diagnostic purposes. By default, like the kernel, a connected conn
+// only receives datagrams sent by its peer. This option has no effect on conns
+// that are not connected, which always receive datagrams from any source.
+func (c *UDPConn) SetAcceptAnySource(enabled bool) error {
+	// fail if the conn is closed, because the select below chooses randomly
+	// among the ready cases and the network could serve the request
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	default:
+	}
+
+	req := &networkSetAcceptAnySource{
+		ack:       make(chan any),
+		enabled:   enabled,
+		err:       nil,
+		localAddr: c.getLocalAddr(),
+	}
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+
+	case <-c.network.closed:
+		return net.ErrClosed
+
+	case c.network.setAcceptAnySource <- req:
+		select {
+		case <-c.network.closed:
+			return net.ErrClosed
+
+		case <-req.ack:
+			return req.err
+		}
+	}
+}
+
+// onSetAcceptAnySource handles a request to configure the source filter of a conn.
+func (n *Network) onSetAcceptAnySource(req *networkSetAcceptAnySource) {
+	// always acknowledge the caller
+	defer close(req.ack)
+
+	// fail if the conn does not exist or RestoreState replaced it with an orphan
+	state := n.udp[req.localAddr]
+	if state == nil || state.orphan {
+		req.err = syscall.EBADF
+		return
+	}
+
+	state.acceptAnySource = req.enabled
+}
@@ -0,0 +1,51 @@
+package netemlite
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestSetAcceptAnySource(t *testing.T) {
+	n := newTestNetwork(t)
+	stranger := newTestConn(t, n, "10.0.0.9:1234", "")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+
+	// by default, a connected conn drops datagrams from other sources
+	if err := <-writeToAsync(stranger, "dropped", "10.0.0.2:53"); err != nil {
+		t.Fatal(err)
+	}
+	if drops := n.Stats().Drops[DropReasonPeerMismatch]; drops != 1 {
+		t.Fatalf("expected 1 drop, got %d", drops)
+	}
+
+	// once enabled, it receives them
+	if err := receiver.SetAcceptAnySource(true); err != nil {
+		t.Fatal(err)
+	}
+	errch := writeToAsync(stranger, "accepted", "10.0.0.2:53")
+	mustRead(t, receiver, "accepted")
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+
+	// disabling restores the default behavior
+	if err := receiver.SetAcceptAnySource(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-writeToAsync(stranger, "dropped", "10.0.0.2:53"); err != nil {
+		t.Fatal(err)
+	}
+	if drops := n.Stats().Drops[DropReasonPeerMismatch]; drops != 2 {
+		t.Fatalf("expected 2 drops, got %d", drops)
+	}
+}
+
+func TestSetAcceptAnySourceClosedConn(t *testing.T) {
+	n := newTestNetwork(t)
+	conn := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	conn.Close()
+	if err := conn.SetAcceptAnySource(true); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package netemlite
+
+//
+// Message-oriented conn wrapper
+//
+
+// FramedConn wraps a connected [UDPConn] such that each message is exactly one
+// datagram and reading a message never truncates it, regardless of its size.
+type FramedConn struct {
+	// conn is the READONLY underlying conn.
+	conn *UDPConn
+}
+
+// NewFramedConn creates a new [FramedConn] wrapping the given connected conn.
+func NewFramedConn(conn *UDPConn) *FramedConn {
+	return &FramedConn{conn: conn}
+}
+
+// Conn returns the underlying conn.
+func (fc *FramedConn) Conn() *UDPConn {
+	return fc.conn
+}
+
+// WriteMessage sends the given message as a single datagram.
+func (fc *FramedConn) WriteMessage(message []byte) error {
+	_, err := fc.conn.Write(message)
+	return err
+}
+
+// ReadMessage reads the next datagram and returns it as a message. Because we
+// borrow the network's buffer, which is as large as the datagram, and then copy
+// the datagram into a buffer of the right size, the message is never truncated.
+// This method reads again after a spurious wakeup (see [Network.SetSpuriousWakeups]),
+// so it only returns an empty message when the peer sent an empty datagram.
+func (fc *FramedConn) ReadMessage() ([]byte, error) {
+	// like ReadBorrow but without returning spurious wakeups as empty datagrams
+	req := fc.conn.newReadRequest(nil)
+	req.borrow = true
+	if err := fc.conn.issueReadSkippingSpurious(req); err != nil {
+		return nil, err
+	}
+	defer fc.conn.network.releaseFunc(req.buffer)()
+	return append([]byte{}, req.buffer[:req.count]...), nil
+}
+
+// Close closes the underlying conn.
+func (fc *FramedConn) Close() error {
+	return fc.conn.Close()
+}
@@ -0,0 +1,97 @@
+package netemlite
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFramedConn(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := NewFramedConn(newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53"))
+	receiver := NewFramedConn(newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234"))
+
+	// the sizes include an empty message and the largest IPv4 payload
+	sizes := []int{0, 1, 512, 1500, 9000, 65507}
+	errch := make(chan error, 1)
+	go func() {
+		for _, size := range sizes {
+			if err := sender.WriteMessage(bytes.Repeat([]byte{byte(size)}, size)); err != nil {
+				errch <- err
+				return
+			}
+		}
+		errch <- nil
+	}()
+
+	for _, size := range sizes {
+		message, err := receiver.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(message, bytes.Repeat([]byte{byte(size)}, size)) {
+			t.Fatalf("expected %d bytes, got %d", size, len(message))
+		}
+	}
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFramedConnMessageOutlivesRead(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := NewFramedConn(newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53"))
+	receiver := NewFramedConn(newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234"))
+
+	// the message returned by a read must not be overwritten by the next read,
+	// which may reuse the buffer borrowed from the network
+	go func() {
+		sender.WriteMessage([]byte("first"))
+		sender.WriteMessage([]byte("second"))
+	}()
+	first, err := receiver.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiver.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if string(first) != "first" {
+		t.Fatalf("expected %q, got %q", "first", first)
+	}
+}
+
+func TestFramedConnSkipsSpuriousWakeups(t *testing.T) {
+	n := newTestNetwork(t)
+	n.SetSpuriousWakeups(1)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	conn := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+
+	// send the message only after the receiver has woken up spuriously
+	wakeup := make(chan struct{}, 1)
+	conn.SetReadBlockObserver(func(blocked bool) {
+		select {
+		case wakeup <- struct{}{}:
+		default:
+		}
+	})
+	go func() {
+		<-wakeup
+		sender.Write([]byte("hello"))
+	}()
+
+	message, err := NewFramedConn(conn).ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(message) != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", message)
+	}
+}
+
+func TestFramedConnConn(t *testing.T) {
+	n := newTestNetwork(t)
+	conn := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	if got := NewFramedConn(conn).Conn(); got != conn {
+		t.Fatal("expected the underlying conn")
+	}
+}
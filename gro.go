@@ -0,0 +1,51 @@
+package netemlite
+
+//
+// Receive-side coalescing (aka GRO)
+//
+
+import "net"
+
+// groMaxSegments is the maximum number of datagrams we coalesce, which is
+// the same limit used by the Linux kernel (UDP_GRO_CNT_MAX).
+const groMaxSegments = 64
+
+// SetGRO controls whether ReadMsgUDPGRO coalesces datagrams (like setting UDP_GRO).
+func (c *UDPConn) SetGRO(enabled bool) {
+	c.gro.Store(enabled)
+}
+
+// ReadMsgUDPGRO is like ReadMsgUDP but, when GRO is enabled (see SetGRO) and several
+// datagrams with the same size, source, and destination are waiting to be read, reads
+// as many of them as fit into the buffer, concatenated, and adds to oob a control
+// message containing the size of each datagram (like UDP_GRO). Use [ParseSegmentSizeOOB]
+// to extract the segment size from the OOB buffer. The control message is missing when
+// the read returns a single datagram.
+func (c *UDPConn) ReadMsgUDPGRO(buffer, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error) {
+	return c.readMsg(buffer, oob, c.gro.Load())
+}
+
+// popCoalescedWritesUDP removes and returns the blocked writes of a conn that we
+// can coalesce with the given write, if the read wants GRO.
+func (n *Network) popCoalescedWritesUDP(read *networkReadUDP, state *networkConnStateUDP, write *networkWriteUDP) (more []*networkWriteUDP) {
+	if !read.gro || len(write.payload) <= 0 {
+		return
+	}
+	size := len(write.payload)
+	for segments := 1; segments < groMaxSegments && len(state.blockedWrites) > 0; segments++ {
+		// we can only coalesce the write we would deliver next
+		next := n.nextWriteUDP(state)
+
+		// stop if the write does not belong to the same flow, has a different
+		// size or ToS, or does not fit into the buffer
+		if next.sourceAddr != write.sourceAddr || next.destAddr != write.destAddr ||
+			len(next.payload) != size || next.tos != write.tos ||
+			len(read.buffer) < size*(segments+1) {
+			return
+		}
+		n.chargeWriteUDP(state, next)
+		state.removeWrite(next)
+		more = append(more, next)
+	}
+	return
+}
@@ -0,0 +1,78 @@
+package netemlite
+
+import "testing"
+
+func TestReadMsgUDPGRO(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	receiver.SetGRO(true)
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "aaaa", "bbbb", "cccc", "dd")
+
+	// the datagrams with the same size are coalesced
+	buffer, oob := make([]byte, 64), make([]byte, 64)
+	count, oobn, _, addr, err := receiver.ReadMsgUDPGRO(buffer, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buffer[:count]); got != "aaaabbbbcccc" {
+		t.Fatalf("unexpected coalesced payload %q", got)
+	}
+	if addr.String() != "10.0.0.1:1234" {
+		t.Fatal("unexpected source address", addr)
+	}
+	if size, found := ParseSegmentSizeOOB(oob[:oobn]); !found || size != 4 {
+		t.Fatalf("expected segment size 4, got %d and %v", size, found)
+	}
+	waitBlockedWrites(t, n, "10.0.0.2:53", 1)
+
+	// a single datagram comes without a segment size
+	count, oobn, _, _, err = receiver.ReadMsgUDPGRO(buffer, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buffer[:count]); got != "dd" {
+		t.Fatalf("unexpected payload %q", got)
+	}
+	if _, found := ParseSegmentSizeOOB(oob[:oobn]); found {
+		t.Fatal("unexpected segment size")
+	}
+}
+
+func TestReadMsgUDPGROBufferLimitsSegments(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	receiver.SetGRO(true)
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "aaaa", "bbbb", "cccc")
+
+	// we only coalesce as many datagrams as fit into the buffer
+	buffer, oob := make([]byte, 10), make([]byte, 64)
+	count, _, flags, _, err := receiver.ReadMsgUDPGRO(buffer, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buffer[:count]); got != "aaaabbbb" || flags&MsgTrunc != 0 {
+		t.Fatalf("unexpected read: %q flags=%d", got, flags)
+	}
+	mustRead(t, receiver, "cccc")
+}
+
+func TestReadMsgUDPGRODisabled(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "aaaa", "bbbb")
+	buffer, oob := make([]byte, 64), make([]byte, 64)
+	count, oobn, _, _, err := receiver.ReadMsgUDPGRO(buffer, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buffer[:count]); got != "aaaa" {
+		t.Fatalf("unexpected payload %q", got)
+	}
+	if _, found := ParseSegmentSizeOOB(oob[:oobn]); found {
+		t.Fatal("unexpected segment size")
+	}
+	mustRead(t, receiver, "bbbb")
+}
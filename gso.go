@@ -0,0 +1,75 @@
+package netemlite
+
+//
+// Send-side segmentation (aka GSO)
+//
+
+import (
+	"net/netip"
+	"syscall"
+)
+
+// gsoMaxSegments is the maximum number of datagrams a single write may
+// produce, which is the same limit used by the Linux kernel (UDP_MAX_SEGMENTS).
+const gsoMaxSegments = 64
+
+// SetGSO sets the segment size used to split the data passed to Write, WriteTo, and
+// WriteMsgUDPWithSource into multiple datagrams (like setting UDP_SEGMENT). Each
+// datagram contains segmentSize bytes, except the last one, which may be shorter.
+// A zero or negative value, which is the default, disables segmentation.
+func (c *UDPConn) SetGSO(segmentSize int) {
+	c.gsoSize.Store(int64(segmentSize))
+}
+
+// WriteMsgUDPGSO is like WriteTo but splits data into datagrams containing segmentSize
+// bytes, except the last one, which may be shorter (like sending with a UDP_SEGMENT
+// control message), overriding the value set using SetGSO. Use a zero dst to write
+// using a connected conn. A zero or negative segmentSize disables segmentation.
+func (c *UDPConn) WriteMsgUDPGSO(data []byte, segmentSize int, dst netip.AddrPort) (int, error) {
+	// select the destination depending on whether we're connected
+	switch {
+	case c.peerAddr.IsValid() && dst.IsValid():
+		return 0, syscall.EISCONN
+	case c.peerAddr.IsValid():
+		dst = c.peerAddr
+	}
+
+	// use common write code
+	return c.writeSegments(data, c.getLocalAddr(), dst, segmentSize)
+}
+
+// writeSegments writes data as a sequence of datagrams with the given segment
+// size. Like the kernel, we validate the size of the segments before sending and
+// report either success or failure for the whole data. If the conn is closed or the
+// write deadline expires midway, we return zero and the error, even though some of
+// the earlier segments may have already been delivered.
+func (c *UDPConn) writeSegments(data []byte, sourceAddr, destAddr netip.AddrPort, segmentSize int) (int, error) {
+	// without segmentation, send a single datagram
+	if segmentSize <= 0 || len(data) <= segmentSize {
+		return c.writeDatagram(data, sourceAddr, destAddr)
+	}
+
+	// make sure we're not creating too many datagrams
+	if (len(data)+segmentSize-1)/segmentSize > gsoMaxSegments {
+		return 0, syscall.EINVAL
+	}
+
+	// make sure the segments are not too large
+	if err := c.checkDatagramSize(segmentSize, destAddr); err != nil {
+		return 0, err
+	}
+
+	// send each segment as a distinct datagram
+	total := len(data)
+	for len(data) > 0 {
+		segment := data
+		if len(segment) > segmentSize {
+			segment = segment[:segmentSize]
+		}
+		if _, err := c.writeDatagram(segment, sourceAddr, destAddr); err != nil {
+			return 0, err
+		}
+		data = data[len(segment):]
+	}
+	return total, nil
+}
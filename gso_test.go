@@ -0,0 +1,108 @@
+package netemlite
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWriteMsgUDPGSO(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+
+	// a buffer containing four segments produces four datagrams
+	const segmentSize = 100
+	data := bytes.Repeat([]byte("abcd"), segmentSize)
+	type result struct {
+		count int
+		err   error
+	}
+	resultch := make(chan result, 1)
+	go func() {
+		count, err := sender.WriteMsgUDPGSO(data, segmentSize, netip.MustParseAddrPort("10.0.0.2:53"))
+		resultch <- result{count, err}
+	}()
+	buffer := make([]byte, 1024)
+	for idx := 0; idx < 4; idx++ {
+		count, addr, err := receiver.ReadFrom(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != segmentSize || !bytes.Equal(buffer[:count], data[idx*segmentSize:(idx+1)*segmentSize]) {
+			t.Fatalf("segment %d: unexpected payload of %d bytes", idx, count)
+		}
+		if addr.String() != "10.0.0.1:1234" {
+			t.Fatal("unexpected source address", addr)
+		}
+	}
+	if res := <-resultch; res.err != nil || res.count != len(data) {
+		t.Fatalf("expected %d bytes, got %d and %v", len(data), res.count, res.err)
+	}
+}
+
+func TestSetGSO(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	sender.SetGSO(4)
+
+	// the last segment may be shorter
+	errch := writeAsync(sender, "aaaabbbbcc")
+	mustRead(t, receiver, "aaaa")
+	mustRead(t, receiver, "bbbb")
+	mustRead(t, receiver, "cc")
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteMsgUDPGSOErrors(t *testing.T) {
+	n := newTestNetwork(t)
+	conn := newTestConn(t, n, "10.0.0.1:1234", "")
+	connected := newTestConn(t, n, "10.0.0.3:1234", "10.0.0.2:53")
+	dst := netip.MustParseAddrPort("10.0.0.2:53")
+
+	// too many segments
+	if _, err := conn.WriteMsgUDPGSO(make([]byte, 65), 1, dst); !errors.Is(err, syscall.EINVAL) {
+		t.Fatalf("expected EINVAL, got %v", err)
+	}
+
+	// segments too large
+	if _, err := conn.WriteMsgUDPGSO(make([]byte, 140000), 70000, dst); !errors.Is(err, syscall.EMSGSIZE) {
+		t.Fatalf("expected EMSGSIZE, got %v", err)
+	}
+
+	// destination with a connected conn
+	if _, err := connected.WriteMsgUDPGSO(make([]byte, 8), 4, dst); !errors.Is(err, syscall.EISCONN) {
+		t.Fatalf("expected EISCONN, got %v", err)
+	}
+}
+
+func TestWriteMsgUDPGSOFailsMidway(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	sender.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+
+	// the receiver only reads the first segment
+	type result struct {
+		count int
+		err   error
+	}
+	resultch := make(chan result, 1)
+	go func() {
+		count, err := sender.WriteMsgUDPGSO([]byte("aaaabbbbccccdddd"), 4, netip.AddrPort{})
+		resultch <- result{count, err}
+	}()
+	mustRead(t, receiver, "aaaa")
+
+	// the whole write fails even though a segment was delivered
+	if res := <-resultch; !errors.Is(res.err, os.ErrDeadlineExceeded) || res.count != 0 {
+		t.Fatalf("expected zero bytes and ErrDeadlineExceeded, got %d and %v", res.count, res.err)
+	}
+}
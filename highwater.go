@@ -0,0 +1,102 @@
+package netemlite
+
+//
+// Receive queue high-water marks
+//
+
+import "net/netip"
+
+// networkHighWaterMarks is a request to get or reset the high-water marks of a conn.
+type networkHighWaterMarks struct {
+	// ack is closed by the Network layer to acknowledge that
+	// it has processed this message.
+	ack chan any
+
+	// bytes is the peak number of queued bytes, set by the Network layer.
+	bytes int
+
+	// datagrams is the peak number of queued datagrams, set by the Network layer.
+	datagrams int
+
+	// localAddr is the local address of the conn.
+	localAddr netip.AddrPort
+
+	// reset indicates that the Network layer should reset the marks.
+	reset bool
+}
+
+// HighWaterMarks returns the peak number of bytes and datagrams waiting to be read
+// by this conn since the conn was created or ResetHighWaterMarks was last called,
+// which allows asserting that buffering never exceeded the expected bounds. The
+// return values are zero if the conn or the network has been closed.
+func (c *UDPConn) HighWaterMarks() (bytes, datagrams int) {
+	req := c.highWaterMarks(false)
+	return req.bytes, req.datagrams
+}
+
+// ResetHighWaterMarks resets the high-water marks returned by HighWaterMarks
+// to the number of bytes and datagrams currently waiting to be read.
+func (c *UDPConn) ResetHighWaterMarks() {
+	c.highWaterMarks(true)
+}
+
+// highWaterMarks gets or resets the high-water marks using the background goroutine.
+func (c *UDPConn) highWaterMarks(reset bool) *networkHighWaterMarks {
+	req := &networkHighWaterMarks{
+		ack:       make(chan any),
+		bytes:     0,
+		datagrams: 0,
+		localAddr: c.getLocalAddr(),
+		reset:     reset,
+	}
+	select {
+	case <-c.closed:
+		// nothing
+
+	case <-c.network.closed:
+		// nothing
+
+	case c.network.highWaterMarks <- req:
+		select {
+		case <-c.network.closed:
+			// nothing
+
+		case <-req.ack:
+			// nothing
+		}
+	}
+	return req
+}
+
+// onHighWaterMarks handles a request to get or reset the high-water marks of a conn.
+func (n *Network) onHighWaterMarks(req *networkHighWaterMarks) {
+	// always acknowledge the caller
+	defer close(req.ack)
+
+	// the conn may have been closed concurrently
+	state := n.udp[req.localAddr]
+	if state == nil {
+		return
+	}
+
+	if req.reset {
+		state.highWaterBytes, state.highWaterDatagrams = 0, 0
+		state.updateHighWaterMarks()
+	}
+	req.bytes, req.datagrams = state.highWaterBytes, state.highWaterDatagrams
+}
+
+// updateHighWaterMarks updates the high-water marks using the current content
+// of the blocked writes, which we MUST call after queueing writes.
+func (state *networkConnStateUDP) updateHighWaterMarks() {
+	var bytes int
+	for _, write := range state.blockedWrites {
+		bytes += len(write.payload)
+	}
+	if bytes > state.highWaterBytes {
+		state.highWaterBytes = bytes
+	}
+	if datagrams := len(state.blockedWrites); datagrams > state.highWaterDatagrams {
+		state.highWaterDatagrams = datagrams
+	}
+}
@@ -0,0 +1,42 @@
+package netemlite
+
+import "testing"
+
+func TestHighWaterMarks(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+
+	// the marks record the peak of a burst after draining it
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "a", "bb", "ccc")
+	for _, expect := range []string{"a", "bb", "ccc"} {
+		mustRead(t, receiver, expect)
+	}
+	if bytes, datagrams := receiver.HighWaterMarks(); bytes != 6 || datagrams != 3 {
+		t.Fatalf("expected 6 bytes and 3 datagrams, got %d and %d", bytes, datagrams)
+	}
+
+	// a smaller burst does not lower the marks
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "dddd")
+	if bytes, datagrams := receiver.HighWaterMarks(); bytes != 6 || datagrams != 3 {
+		t.Fatalf("expected 6 bytes and 3 datagrams, got %d and %d", bytes, datagrams)
+	}
+
+	// resetting uses what is currently queued
+	receiver.ResetHighWaterMarks()
+	if bytes, datagrams := receiver.HighWaterMarks(); bytes != 4 || datagrams != 1 {
+		t.Fatalf("expected 4 bytes and 1 datagram, got %d and %d", bytes, datagrams)
+	}
+	mustRead(t, receiver, "dddd")
+}
+
+func TestHighWaterMarksClosedConn(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "hello")
+	receiver.Close()
+	if bytes, datagrams := receiver.HighWaterMarks(); bytes != 0 || datagrams != 0 {
+		t.Fatalf("expected zero marks, got %d and %d", bytes, datagrams)
+	}
+}
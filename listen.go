@@ -0,0 +1,76 @@
+package netemlite
+
+//
+// Factories using network and address strings
+//
+
+import (
+	"net"
+	"net/netip"
+)
+
+// ListenPacket creates a non-connected [UDPConn] bound to the given address, which
+// allows using a [Network] where code expects a ListenPacket method. The network
+// argument must be one of "udp", "udp4", and "udp6".
+func (n *Network) ListenPacket(network, address string) (net.PacketConn, error) {
+	localAddr, err := parseUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := NewUDPConn(n, localAddr, netip.AddrPort{})
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Dial creates a [UDPConn] connected to the given address and bound to an ephemeral
+// port (see [AddressAllocator]) of the unspecified address of the same family, which
+// allows using a [Network] where code expects a Dial method. The network argument
+// must be one of "udp", "udp4", and "udp6". Like connecting a real UDP socket, Dial
+// does not fail when nobody is bound to the address: with ICMP errors enabled (see
+// [Network.SetICMPErrors]), a subsequent write reports [syscall.ECONNREFUSED].
+func (n *Network) Dial(network, address string) (net.Conn, error) {
+	peer, err := parseUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := NewUDPConn(n, unspecifiedAddrPort(peer), peer)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// unspecifiedAddrPort returns the unspecified address of the same family of
+// the given address with port zero, which is suitable for ephemeral binds.
+func unspecifiedAddrPort(addr netip.AddrPort) netip.AddrPort {
+	if addr.Addr().Is4() {
+		return netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+	}
+	return netip.AddrPortFrom(netip.IPv6Unspecified(), 0)
+}
+
+// parseUDPAddr parses an UDP address ensuring it is consistent with the network.
+func parseUDPAddr(network, address string) (netip.AddrPort, error) {
+	addr, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return netip.AddrPort{}, &net.AddrError{Err: err.Error(), Addr: address}
+	}
+	switch network {
+	case "udp":
+		return addr, nil
+	case "udp4":
+		if !addr.Addr().Is4() {
+			return netip.AddrPort{}, &net.AddrError{Err: "expected an IPv4 address", Addr: address}
+		}
+		return addr, nil
+	case "udp6":
+		if !addr.Addr().Is6() {
+			return netip.AddrPort{}, &net.AddrError{Err: "expected an IPv6 address", Addr: address}
+		}
+		return addr, nil
+	default:
+		return netip.AddrPort{}, net.UnknownNetworkError(network)
+	}
+}
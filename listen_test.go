@@ -0,0 +1,84 @@
+package netemlite
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestDialAndListenPacket(t *testing.T) {
+	n := newTestNetwork(t)
+	pconn, err := n.ListenPacket("udp", "10.0.0.2:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pconn.Close()
+	conn, err := n.Dial("udp4", "10.0.0.2:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the dialed conn is bound to an ephemeral port
+	local := conn.LocalAddr().(*net.UDPAddr)
+	if !local.IP.IsUnspecified() || local.Port == 0 {
+		t.Fatalf("unexpected local address %s", local)
+	}
+
+	// send a query and reply to it
+	go conn.Write([]byte("query"))
+	buffer := make([]byte, 64)
+	count, addr, err := pconn.ReadFrom(buffer)
+	if err != nil || string(buffer[:count]) != "query" || addr.(*net.UDPAddr).Port != local.Port {
+		t.Fatal("unexpected query", err, string(buffer[:count]), addr)
+	}
+	go pconn.WriteTo([]byte("response"), addr)
+	count, err = conn.Read(buffer)
+	if err != nil || string(buffer[:count]) != "response" {
+		t.Fatal("unexpected response", err, string(buffer[:count]))
+	}
+}
+
+func TestDialAndListenPacketInvalidArguments(t *testing.T) {
+	n := newTestNetwork(t)
+	for _, tc := range []struct {
+		network, address string
+	}{
+		{"tcp", "10.0.0.2:53"},
+		{"udp6", "10.0.0.2:53"},
+		{"udp4", "[::1]:53"},
+		{"udp", "10.0.0.2"},
+	} {
+		if _, err := n.Dial(tc.network, tc.address); err == nil {
+			t.Fatalf("Dial(%q, %q): expected an error", tc.network, tc.address)
+		}
+		if _, err := n.ListenPacket(tc.network, tc.address); err == nil {
+			t.Fatalf("ListenPacket(%q, %q): expected an error", tc.network, tc.address)
+		}
+	}
+	var unknown net.UnknownNetworkError
+	if _, err := n.Dial("tcp", "10.0.0.2:53"); !errors.As(err, &unknown) {
+		t.Fatalf("expected an UnknownNetworkError, got %v", err)
+	}
+}
+
+func TestDialDefersICMPErrors(t *testing.T) {
+	n := newTestNetwork(t)
+	n.SetICMPErrors(true)
+
+	// like a real connect, dialing succeeds even though nobody is bound
+	conn, err := n.Dial("udp", "10.0.0.2:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the first write triggers the ICMP error and the second reports it
+	if _, err := conn.Write([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("second")); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("expected ECONNREFUSED, got %v", err)
+	}
+}
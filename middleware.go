@@ -0,0 +1,143 @@
+package netemlite
+
+//
+// Middleware for processing requests
+//
+
+// RequestKind is the kind of a [Request].
+type RequestKind int
+
+const (
+	// RequestNewConnUDP is a request to register an UDP conn.
+	RequestNewConnUDP = RequestKind(iota + 1)
+
+	// RequestDeleteConnUDP is a request to unregister an UDP conn.
+	RequestDeleteConnUDP
+
+	// RequestReadUDP is a request to read an UDP datagram.
+	RequestReadUDP
+
+	// RequestWriteUDP is a request to write an UDP datagram.
+	RequestWriteUDP
+)
+
+// Request is a request processed by the [Network] background goroutine.
+type Request interface {
+	// Kind returns the request kind.
+	Kind() RequestKind
+
+	// Complete acknowledges the request without processing it, such that
+	// the corresponding operation fails with the given error. Completing a
+	// write with a nil error silently drops the datagram, which is reported
+	// using [DropReasonMiddleware]. You MUST NOT call Complete more than once
+	// and you MUST NOT pass to the next handler a completed request.
+	Complete(err error)
+}
+
+// RequestHandler handles a [Request].
+type RequestHandler interface {
+	Handle(req Request)
+}
+
+// RequestHandlerFunc is a func implementing [RequestHandler].
+type RequestHandlerFunc func(req Request)
+
+var _ RequestHandler = RequestHandlerFunc(nil)
+
+// Handle implements RequestHandler.
+func (fn RequestHandlerFunc) Handle(req Request) {
+	fn(req)
+}
+
+// Use wraps the handler processing requests with the given middleware, which
+// allows tests to intercept or modify any request before the default handler
+// processes it. The most recently installed middleware runs first.
+//
+// The middleware runs in the background goroutine of the [Network] and MUST
+// either complete the request or pass it to the next handler before returning.
+// Blocking inside the middleware blocks the whole network, and so does calling
+// methods that wait for the background goroutine, such as Dump or Stats.
+func (n *Network) Use(mw func(next RequestHandler) RequestHandler) {
+	n.mu.Lock()
+	n.handler = mw(n.handler)
+	n.mu.Unlock()
+}
+
+// handle dispatches a request to the current handler.
+func (n *Network) handle(req Request) {
+	n.mu.Lock()
+	handler := n.handler
+	n.mu.Unlock()
+	handler.Handle(req)
+
+	// account for writes dropped by middleware
+	if write, ok := req.(*networkWriteUDP); ok && write.dropReason == DropReasonMiddleware {
+		n.drops[DropReasonMiddleware]++
+	}
+}
+
+// networkDefaultHandler is the default [RequestHandler].
+type networkDefaultHandler struct {
+	n *Network
+}
+
+// Handle implements RequestHandler.
+func (h *networkDefaultHandler) Handle(req Request) {
+	switch req := req.(type) {
+	case *networkNewConnUDP:
+		h.n.onNewConnUDP(req)
+	case *networkDeleteConnUDP:
+		h.n.onDeleteConnUDP(req)
+	case *networkReadUDP:
+		h.n.onReadUDP(req)
+	case *networkWriteUDP:
+		h.n.onWriteUDP(req)
+	}
+}
+
+// Kind implements Request.
+func (req *networkNewConnUDP) Kind() RequestKind {
+	return RequestNewConnUDP
+}
+
+// Complete implements Request.
+func (req *networkNewConnUDP) Complete(err error) {
+	req.err = err
+	close(req.ack)
+}
+
+// Kind implements Request.
+func (req *networkDeleteConnUDP) Kind() RequestKind {
+	return RequestDeleteConnUDP
+}
+
+// Complete implements Request.
+func (req *networkDeleteConnUDP) Complete(err error) {
+	req.err = err
+	close(req.ack)
+}
+
+// Kind implements Request.
+func (req *networkReadUDP) Kind() RequestKind {
+	return RequestReadUDP
+}
+
+// Complete implements Request.
+func (req *networkReadUDP) Complete(err error) {
+	req.err = err
+	close(req.ack)
+}
+
+// Kind implements Request.
+func (req *networkWriteUDP) Kind() RequestKind {
+	return RequestWriteUDP
+}
+
+// Complete implements Request.
+func (req *networkWriteUDP) Complete(err error) {
+	if err == nil {
+		req.dropReason = DropReasonMiddleware
+	}
+	req.err = err
+	close(req.ack)
+}
@@ -0,0 +1,78 @@
+package netemlite
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"syscall"
+	"testing"
+)
+
+func TestMiddlewareDropsEveryThirdWrite(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+
+	// the middleware runs in the background goroutine, so the counter
+	// does not need to be protected by a mutex
+	var writes int
+	n.Use(func(next RequestHandler) RequestHandler {
+		return RequestHandlerFunc(func(req Request) {
+			if req.Kind() == RequestWriteUDP {
+				if writes++; writes%3 == 0 {
+					req.Complete(nil)
+					return
+				}
+			}
+			next.Handle(req)
+		})
+	})
+
+	// read the datagrams that we expect to be delivered
+	received := make(chan string, 6)
+	go func() {
+		buffer := make([]byte, 64)
+		for idx := 0; idx < 4; idx++ {
+			count, err := receiver.Read(buffer)
+			if err != nil {
+				break
+			}
+			received <- string(buffer[:count])
+		}
+		close(received)
+	}()
+
+	// writes return once delivered or dropped, so the order is deterministic
+	for idx := 1; idx <= 6; idx++ {
+		if _, err := sender.Write([]byte(fmt.Sprint(idx))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	for payload := range received {
+		got = append(got, payload)
+	}
+	if fmt.Sprint(got) != "[1 2 4 5]" {
+		t.Fatalf("unexpected delivery pattern %v", got)
+	}
+	if drops := n.Stats().Drops[DropReasonMiddleware]; drops != 2 {
+		t.Fatalf("expected 2 drops, got %d", drops)
+	}
+}
+
+func TestMiddlewareCompletesWithError(t *testing.T) {
+	n := newTestNetwork(t)
+	n.Use(func(next RequestHandler) RequestHandler {
+		return RequestHandlerFunc(func(req Request) {
+			if req.Kind() == RequestNewConnUDP {
+				req.Complete(syscall.EACCES)
+				return
+			}
+			next.Handle(req)
+		})
+	})
+	_, err := NewUDPConn(n, netip.MustParseAddrPort("10.0.0.1:1234"), netip.AddrPort{})
+	if !errors.Is(err, syscall.EACCES) {
+		t.Fatalf("expected EACCES, got %v", err)
+	}
+}
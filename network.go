@@ -5,33 +5,173 @@ package netemlite
 //
 
 import (
+	"math/rand"
+	"net"
 	"net/netip"
 	"sync"
 	"syscall"
+	"time"
 )
 
 // Network simulates a TCP/IP network. The zero value is
 // invalid; please, use [NewNetwork] to construct.
 type Network struct {
+	// ackDelay is the delay before acknowledging accepted writes.
+	ackDelay time.Duration
+
+	// addressAllocator allocates addresses for port-zero binds.
+	addressAllocator AddressAllocator
+
+	// bindDelay is the delay before binding new conns.
+	bindDelay time.Duration
+
+	// bindFaultInjector is the OPTIONAL function to make binds fail.
+	bindFaultInjector func(addr netip.AddrPort) error
+
+	// blackholes contains the blackholed prefixes.
+	blackholes []netip.Prefix
+
+	// buffers is the pool of buffers used by borrowed reads.
+	buffers sync.Pool
+
+	// cancelAllPending receives requests to fail all the blocked reads and writes.
+	cancelAllPending chan *networkCancelAllPending
+
+	// cancelReadUDP receives requests to cancel blocked UDP reads.
+	cancelReadUDP chan *networkCancelReadUDP
+
+	// cancelWriteUDP receives requests to cancel blocked UDP writes.
+	cancelWriteUDP chan *networkCancelWriteUDP
+
 	// closed is closed by Close to terminate the Network layer.
 	closed chan any
 
+	// defaultReadTimeout is the read timeout of new conns.
+	defaultReadTimeout time.Duration
+
+	// defaultWriteTimeout is the write timeout of new conns.
+	defaultWriteTimeout time.Duration
+
 	// deleteConnUDP receives requests to delete UDP conns.
 	deleteConnUDP chan *networkDeleteConnUDP
 
+	// deliveryLog contains the sequence numbers of the delivered datagrams
+	// by destination address, or is nil when we're not recording them.
+	// This field is protected by mu.
+	deliveryLog map[netip.AddrPort][]uint64
+
+	// drainWaiters contains the requests waiting for queued datagrams to be
+	// delivered. This field is EXCLUSIVELY MUTATED by the background worker
+	// goroutine.
+	drainWaiters []*networkWaitDrained
+
+	// draining indicates that CloseWithTimeout is in progress.
+	draining bool
+
+	// drops counts the dropped datagrams by reason. This field is
+	// EXCLUSIVELY MUTATED by the background worker goroutine.
+	drops map[DropReason]uint64
+
+	// dump receives requests to snapshot the network state.
+	dump chan *networkDump
+
+	// ecnThreshold is the queue length above which we mark ECN-capable
+	// datagrams as congestion experienced (zero or negative means never).
+	ecnThreshold int
+
+	// handler is the handler for requests, possibly wrapped by middleware.
+	handler RequestHandler
+
+	// highWaterMarks receives requests to get or reset high-water marks.
+	highWaterMarks chan *networkHighWaterMarks
+
+	// icmpErrors indicates whether to simulate ICMP errors.
+	icmpErrors bool
+
+	// lookupConnUDP receives requests to check whether conns are bound.
+	lookupConnUDP chan *networkLookupConnUDP
+
+	// maxBatch is the maximum number of writes to process at once.
+	maxBatch int
+
+	// maxConns is the maximum number of conns (zero or negative means unlimited).
+	maxConns int
+
+	// mtu is the MTU (zero or negative means unlimited).
+	mtu int
+
+	// mu protects the configuration fields.
+	mu sync.Mutex
+
 	// newConnUDP receives requests to track UDP conns.
 	newConnUDP chan *networkNewConnUDP
 
+	// nextConnID is the ID of the last conn. This field is
+	// EXCLUSIVELY MUTATED by the background worker goroutine.
+	nextConnID uint64
+
+	// nextSeq is the sequence number of the next datagram. This field is
+	// EXCLUSIVELY MUTATED by the background worker goroutine.
+	nextSeq uint64
+
 	// once ensures that Close has "once" semantics.
 	once sync.Once
 
+	// partitions contains the pairs of prefixes between which we drop datagrams.
+	partitions [][2]netip.Prefix
+
+	// paused indicates that delivery is paused. This field is
+	// EXCLUSIVELY MUTATED by the background worker goroutine.
+	paused bool
+
+	// payloadRewriter is the OPTIONAL function to rewrite payloads.
+	payloadRewriter func(pkt CapturedPacket) []byte
+
+	// priorityQueues maps DSCP values to the weight of their queue.
+	priorityQueues map[byte]int
+
+	// readErrorQueue receives requests to pop the pending error of a conn.
+	readErrorQueue chan *networkReadErrorQueue
+
 	// readUDP receives requests to read UDP datagrams.
 	readUDP chan *networkReadUDP
 
+	// rebindUDP receives requests to rebind UDP conns.
+	rebindUDP chan *networkRebindUDP
+
+	// restoreState receives requests to restore the network state.
+	restoreState chan *networkRestoreState
+
+	// reversePathFilter indicates whether to drop spoofed datagrams.
+	reversePathFilter bool
+
+	// rng is the random number generator used to simulate spurious wakeups.
+	rng *rand.Rand
+
+	// saveState receives requests to save the network state.
+	saveState chan *networkSaveState
+
+	// setAcceptAnySource receives requests to configure source filters.
+	setAcceptAnySource chan *networkSetAcceptAnySource
+
+	// setPausedUDP receives requests to pause or resume delivery.
+	setPausedUDP chan *networkSetPaused
+
+	// spuriousWakeups is the probability of spurious wakeups.
+	spuriousWakeups float64
+
+	// stats receives requests to obtain statistics.
+	stats chan *networkStats
+
 	// udp tracks all the currently open UDP conns. This field is
-	// EXCLUSIVELY MUTATED by the background worker goroutine.
+	// EXCLUSIVELY MUTATED by the background worker goroutine. Because
+	// the key is the full address, conns bound to the same port on
+	// different IP addresses do not conflict with each other.
 	udp map[netip.AddrPort]*networkConnStateUDP
 
+	// waitDrained receives requests to wait until no datagrams are queued.
+	waitDrained chan *networkWaitDrained
+
 	// writeUDP receives requests to write UDP datagrams.
 	writeUDP chan *networkWriteUDP
 }
@@ -40,14 +180,57 @@ type Network struct {
 // for processing network events that runs until you call the Close method.
 func NewNetwork() *Network {
 	n := &Network{
-		closed:        make(chan any),
-		deleteConnUDP: make(chan *networkDeleteConnUDP),
-		newConnUDP:    make(chan *networkNewConnUDP),
-		once:          sync.Once{},
-		readUDP:       make(chan *networkReadUDP),
-		udp:           map[netip.AddrPort]*networkConnStateUDP{},
-		writeUDP:      make(chan *networkWriteUDP),
+		ackDelay:            0,
+		addressAllocator:    newEphemeralAllocator(),
+		bindDelay:           0,
+		bindFaultInjector:   nil,
+		blackholes:          []netip.Prefix{},
+		buffers:             sync.Pool{},
+		cancelAllPending:    make(chan *networkCancelAllPending),
+		cancelReadUDP:       make(chan *networkCancelReadUDP),
+		cancelWriteUDP:      make(chan *networkCancelWriteUDP),
+		closed:              make(chan any),
+		defaultReadTimeout:  0,
+		defaultWriteTimeout: 0,
+		deleteConnUDP:       make(chan *networkDeleteConnUDP),
+		deliveryLog:         nil,
+		drainWaiters:        nil,
+		drops:               map[DropReason]uint64{},
+		draining:            false,
+		dump:                make(chan *networkDump),
+		ecnThreshold:        0,
+		handler:             nil,
+		highWaterMarks:      make(chan *networkHighWaterMarks),
+		icmpErrors:          false,
+		lookupConnUDP:       make(chan *networkLookupConnUDP),
+		maxBatch:            0,
+		maxConns:            0,
+		mtu:                 0,
+		mu:                  sync.Mutex{},
+		newConnUDP:          make(chan *networkNewConnUDP),
+		nextConnID:          0,
+		nextSeq:             0,
+		once:                sync.Once{},
+		partitions:          [][2]netip.Prefix{},
+		paused:              false,
+		payloadRewriter:     nil,
+		priorityQueues:      map[byte]int{},
+		readErrorQueue:      make(chan *networkReadErrorQueue),
+		readUDP:             make(chan *networkReadUDP),
+		rebindUDP:           make(chan *networkRebindUDP),
+		restoreState:        make(chan *networkRestoreState),
+		reversePathFilter:   false,
+		rng:                 newDefaultRand(),
+		saveState:           make(chan *networkSaveState),
+		setAcceptAnySource:  make(chan *networkSetAcceptAnySource),
+		setPausedUDP:        make(chan *networkSetPaused),
+		spuriousWakeups:     0,
+		stats:               make(chan *networkStats),
+		udp:                 map[netip.AddrPort]*networkConnStateUDP{},
+		waitDrained:         make(chan *networkWaitDrained),
+		writeUDP:            make(chan *networkWriteUDP),
 	}
+	n.handler = &networkDefaultHandler{n}
 	go n.loop()
 	return n
 }
@@ -60,13 +243,293 @@ func (n *Network) Close() error {
 	return nil
 }
 
+// SetMaxConns sets the maximum number of conns that may be open at the same
+// time. Once the limit is reached, [NewUDPConn] fails with [syscall.EMFILE]
+// until some conn is closed. A zero or negative value means unlimited.
+func (n *Network) SetMaxConns(count int) {
+	n.mu.Lock()
+	n.maxConns = count
+	n.mu.Unlock()
+}
+
+// AddBlackhole causes the network to silently drop all the datagrams sent
+// to addresses within the given prefix, regardless of whether there is a
+// conn bound to the destination address, which models null routing.
+func (n *Network) AddBlackhole(prefix netip.Prefix) {
+	n.mu.Lock()
+	n.blackholes = append(n.blackholes, prefix.Masked())
+	n.mu.Unlock()
+}
+
+// SetReversePathFilter controls whether the network drops datagrams whose
+// source address does not belong to the address the sending conn is bound
+// to, which models BCP38-style anti-spoofing (aka uRPF). Spoofing is only
+// possible using [UDPConn.WriteMsgUDPWithSource].
+func (n *Network) SetReversePathFilter(enabled bool) {
+	n.mu.Lock()
+	n.reversePathFilter = enabled
+	n.mu.Unlock()
+}
+
+// selectSourceAddr replaces the unspecified source address of a datagram sent by a
+// conn bound to the wildcard address with a concrete address. Because all the conns
+// live on the same simulated host, we do what the kernel does for local destinations
+// and use the destination address, keeping the source port.
+func selectSourceAddr(write *networkWriteUDP) {
+	source, dest := write.sourceAddr, write.destAddr
+	if source.Addr().IsUnspecified() && source.Addr().Is4() == dest.Addr().Is4() {
+		write.sourceAddr = netip.AddrPortFrom(dest.Addr(), source.Port())
+	}
+}
+
+// isSpoofed returns whether the reverse path filter should drop the datagram.
+func (n *Network) isSpoofed(write *networkWriteUDP) bool {
+	n.mu.Lock()
+	enabled := n.reversePathFilter
+	n.mu.Unlock()
+	if !enabled || write.sourceAddr == write.boundAddr {
+		return false
+	}
+
+	// a conn bound to the wildcard address may use any address
+	// of the same family provided that the port is the same
+	bound, source := write.boundAddr, write.sourceAddr
+	wildcard := bound.Addr().IsUnspecified() && bound.Addr().Is4() == source.Addr().Is4()
+	return !wildcard || bound.Port() != source.Port()
+}
+
+// SetBindFaultInjector sets a function called whenever a conn is about to be
+// bound to an address. When the function returns an error, the bind fails with
+// that error, which allows simulating errors such as [syscall.EADDRINUSE] or
+// [syscall.EACCES] for specific addresses. The function runs in the background
+// goroutine of the network and MUST NOT block or call methods that wait for such
+// a goroutine (e.g., Dump), otherwise the network hangs. A nil value disables
+// injection.
+func (n *Network) SetBindFaultInjector(fn func(addr netip.AddrPort) error) {
+	n.mu.Lock()
+	n.bindFaultInjector = fn
+	n.mu.Unlock()
+}
+
+// SetDefaultDeadlines sets the read and write timeouts of the conns created
+// afterwards. Before each read (or write), such conns set their read (or write)
+// deadline to the current time plus the timeout, which catches hangs without
+// calling SetDeadline. Calling SetReadDeadline (or SetWriteDeadline) on a conn
+// disables its default read (or write) timeout. A zero or negative value, which
+// is the default, means no timeout.
+func (n *Network) SetDefaultDeadlines(read, write time.Duration) {
+	n.mu.Lock()
+	n.defaultReadTimeout = read
+	n.defaultWriteTimeout = write
+	n.mu.Unlock()
+}
+
+// getDefaultDeadlines returns the default read and write timeouts.
+func (n *Network) getDefaultDeadlines() (read, write time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.defaultReadTimeout, n.defaultWriteTimeout
+}
+
+// SetMTU sets the MTU of the network, i.e., the maximum size of an IP packet,
+// including the IP and UDP headers. Because we do not simulate fragmentation, the
+// MTU only matters for conns that set the Don't Fragment bit, which fail to send
+// larger datagrams (see [UDPConn.SetDontFragment]). A zero or negative value,
+// which is the default, means that the MTU is unlimited.
+func (n *Network) SetMTU(mtu int) {
+	n.mu.Lock()
+	n.mtu = mtu
+	n.mu.Unlock()
+}
+
+// getMTU returns the MTU.
+func (n *Network) getMTU() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.mtu
+}
+
+// SetPriorityQueues maps the DSCP values (i.e., the upper six bits of the ToS byte
+// set using [UDPConn.SetTOS]) to the weights of distinct queues. When several queues
+// have datagrams waiting to be read by a conn, reads serve each queue in proportion
+// to its weight, using smooth weighted round robin, such that the queue with the
+// largest weight goes first but does not starve the others. DSCP values not in the
+// map, or mapped to a weight lower than one, share a queue with weight one. A nil or
+// empty map, which is the default, means that datagrams are read in sending order.
+func (n *Network) SetPriorityQueues(queues map[byte]int) {
+	copied := map[byte]int{}
+	for dscp, priority := range queues {
+		copied[dscp] = priority
+	}
+	n.mu.Lock()
+	n.priorityQueues = copied
+	n.mu.Unlock()
+}
+
+// SetSpuriousWakeups sets the probability that a read that would block instead
+// returns immediately with zero bytes, a nil error, and no datagram, which allows
+// testing that read loops do not mistake an empty read for EOF. Such reads do not
+// count as datagrams read and return the zero address as the sender. A zero or
+// negative value, which is the default, disables spurious wakeups.
+func (n *Network) SetSpuriousWakeups(p float64) {
+	n.mu.Lock()
+	n.spuriousWakeups = p
+	n.mu.Unlock()
+}
+
+// SetRandomSource sets the source of the random numbers used to simulate spurious
+// wakeups, which allows reproducing a run using a source with a fixed seed. A nil
+// value, which is the default, means using a source seeded with the current time.
+func (n *Network) SetRandomSource(src rand.Source) {
+	rng := newDefaultRand()
+	if src != nil {
+		rng = rand.New(src)
+	}
+	n.mu.Lock()
+	n.rng = rng
+	n.mu.Unlock()
+}
+
+// newDefaultRand returns a random number generator seeded with the current time.
+func newDefaultRand() *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+// isSpuriousWakeup returns whether to simulate a spurious wakeup.
+func (n *Network) isSpuriousWakeup() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.spuriousWakeups > 0 && n.rng.Float64() < n.spuriousWakeups
+}
+
+// SetICMPErrors controls whether to simulate ICMP errors. When enabled, sending
+// from a connected conn to an address where no conn is bound causes the next
+// write of that conn to fail with [syscall.ECONNREFUSED], once, like a kernel
+// reporting an ICMP port unreachable error. This allows connected conns to
+// notice that their peer has gone away.
+func (n *Network) SetICMPErrors(enabled bool) {
+	n.mu.Lock()
+	n.icmpErrors = enabled
+	n.mu.Unlock()
+}
+
+// SetBatchProcessing configures the background goroutine to process up to
+// maxBatch writes at once, by draining the writes that are immediately available
+// after receiving one before waiting for other kinds of requests. This reduces the
+// per-datagram overhead and preserves the order of writes. A value lower than two
+// disables batching.
+func (n *Network) SetBatchProcessing(maxBatch int) {
+	n.mu.Lock()
+	n.maxBatch = maxBatch
+	n.mu.Unlock()
+}
+
+// handleMoreWrites handles the writes immediately available when batching.
+func (n *Network) handleMoreWrites() {
+	n.mu.Lock()
+	maxBatch := n.maxBatch
+	n.mu.Unlock()
+	for idx := 1; idx < maxBatch; idx++ {
+		select {
+		case req := <-n.writeUDP:
+			n.handle(req)
+		default:
+			return
+		}
+	}
+}
+
+// isBlackholed returns whether the given address is blackholed.
+func (n *Network) isBlackholed(addr netip.Addr) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, prefix := range n.blackholes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetPartition partitions the network by dropping the datagrams sent from addresses
+// within a to addresses within b and vice versa, while the traffic within each side
+// flows normally, which models a netsplit. Calling this method more than once creates
+// multiple partitions, which all apply. Use ClearPartitions to heal the network.
+func (n *Network) SetPartition(a, b netip.Prefix) {
+	n.mu.Lock()
+	n.partitions = append(n.partitions, [2]netip.Prefix{a.Masked(), b.Masked()})
+	n.mu.Unlock()
+}
+
+// ClearPartitions removes all the partitions created using SetPartition.
+func (n *Network) ClearPartitions() {
+	n.mu.Lock()
+	n.partitions = [][2]netip.Prefix{}
+	n.mu.Unlock()
+}
+
+// isPartitioned returns whether a partition separates the given addresses.
+func (n *Network) isPartitioned(source, dest netip.Addr) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, p := range n.partitions {
+		if (p[0].Contains(source) && p[1].Contains(dest)) || (p[1].Contains(source) && p[0].Contains(dest)) {
+			return true
+		}
+	}
+	return false
+}
+
 // networkConnStateUDP contains the state of an UDP connection.
 type networkConnStateUDP struct {
+	// acceptAnySource indicates whether a connected conn receives
+	// datagrams sent by any source rather than only by its peer.
+	acceptAnySource bool
+
 	// blockedReads contains the blocked reads.
 	blockedReads []*networkReadUDP
 
 	// blockedWrites contains the blocked writes.
 	blockedWrites []*networkWriteUDP
+
+	// highWaterBytes is the peak number of bytes in blockedWrites
+	// since the conn was created or the marks were last reset.
+	highWaterBytes int
+
+	// highWaterDatagrams is the peak number of datagrams in blockedWrites
+	// since the conn was created or the marks were last reset.
+	highWaterDatagrams int
+
+	// id uniquely identifies the conn, such that receivers can recognize
+	// the datagrams it sends even after it moves using Rebind.
+	id uint64
+
+	// orphan indicates that RestoreState recreated this conn after its
+	// [UDPConn] was closed, so the next bind may take it over.
+	orphan bool
+
+	// peerAddr is the OPTIONAL address of the peer of a connected conn.
+	peerAddr netip.AddrPort
+
+	// pendingErr is the OPTIONAL error caused by a previous ICMP error.
+	pendingErr error
+
+	// queueCredits contains the credits of each priority queue used
+	// to implement weighted delivery (see SetPriorityQueues).
+	queueCredits map[int]int
+
+	// queuedWrites is the number of writes ever queued, which we use
+	// to order the writes of distinct DSCP values.
+	queuedWrites uint64
+
+	// readReady is the OPTIONAL channel used to notify the [UDPConn]
+	// that there are datagrams to read (see ReadReady).
+	readReady chan struct{}
+
+	// writeQueues contains the blocked writes of each DSCP value in FIFO
+	// order, such that we only need to look at the head of each FIFO to
+	// select the next write to deliver (see nextWriteUDP).
+	writeQueues map[byte][]*networkWriteUDP
 }
 
 // networkNewConnUDP is a request to track a UDP conn.
@@ -80,6 +543,13 @@ type networkNewConnUDP struct {
 
 	// localAddr is the UDP conn address.
 	localAddr netip.AddrPort
+
+	// peerAddr is the OPTIONAL UDP conn peer address.
+	peerAddr netip.AddrPort
+
+	// readReady is the channel used to notify the UDP conn
+	// that there are datagrams to read.
+	readReady chan struct{}
 }
 
 // networkDeleteConnUDP is a request to delete a UDP conn.
@@ -95,23 +565,87 @@ type networkDeleteConnUDP struct {
 	localAddr netip.AddrPort
 }
 
+// networkRebindUDP is a request to move a UDP conn to another address.
+type networkRebindUDP struct {
+	// ack is closed by the Network layer to acknowledge that
+	// it has processed this message.
+	ack chan any
+
+	// err is the error set by the Network layer.
+	err error
+
+	// newAddr is the new UDP conn address.
+	newAddr netip.AddrPort
+
+	// oldAddr is the old UDP conn address.
+	oldAddr netip.AddrPort
+}
+
 // networkWriteUDP is a request to write a datagram.
 type networkWriteUDP struct {
 	// ack is closed by the Network layer to acknowledge that
 	// it has processed this message.
 	ack chan any
 
+	// blockedOn is the conn whose blockedWrites contains this write,
+	// EXCLUSIVELY MUTATED by the background worker goroutine.
+	blockedOn *networkConnStateUDP
+
+	// boundAddr is the local address of the conn sending the datagram.
+	boundAddr netip.AddrPort
+
 	// destAddr is the destination address of the datagram.
 	destAddr netip.AddrPort
 
+	// dropReason is set by the Network layer when it drops the datagram.
+	dropReason DropReason
+
 	// err is the error set by the Network layer.
 	err error
 
+	// flowID is the ID of the sending conn set by the Network layer or
+	// zero if the sending conn is unknown.
+	flowID uint64
+
 	// payload is the datagram payload.
 	payload []byte
 
+	// queueOrder is the order in which the write was queued into
+	// the blockedWrites of blockedOn.
+	queueOrder uint64
+
+	// seq is the datagram sequence number set by the Network layer.
+	seq uint64
+
+	// size is the number of bytes written by the caller, which may differ
+	// from the length of payload if the Network layer rewrites it.
+	size int
+
 	// sourceAddr is the source address of the datagram.
 	sourceAddr netip.AddrPort
+
+	// tos is the ToS byte of the datagram.
+	tos byte
+}
+
+// networkCancelReadUDP is a request to cancel a blocked read.
+type networkCancelReadUDP struct {
+	// ack is closed by the Network layer to acknowledge that
+	// it has processed this message.
+	ack chan any
+
+	// read is the read to cancel.
+	read *networkReadUDP
+}
+
+// networkCancelWriteUDP is a request to cancel a blocked write.
+type networkCancelWriteUDP struct {
+	// ack is closed by the Network layer to acknowledge that
+	// it has processed this message.
+	ack chan any
+
+	// write is the write to cancel.
+	write *networkWriteUDP
 }
 
 // networkReadUDP is a request to read a datagram.
@@ -120,41 +654,138 @@ type networkReadUDP struct {
 	// it has processed this message.
 	ack chan any
 
+	// blockObserver is the OPTIONAL observer told whether the read blocks.
+	blockObserver func(blocked bool)
+
+	// blockedOn is the conn whose blockedReads contains this read,
+	// EXCLUSIVELY MUTATED by the background worker goroutine.
+	blockedOn *networkConnStateUDP
+
+	// borrow indicates that the Network layer should set buffer
+	// using a buffer obtained from its pool of buffers.
+	borrow bool
+
 	// buffer is the buffer to contain the payload, written by the Network layer.
 	buffer []byte
 
 	// count is the number of bytes written, set by the Network layer.
 	count int
 
+	// destAddr is the destination address of the datagram, set by the Network layer.
+	destAddr netip.AddrPort
+
 	// err is the error set by the Network layer.
 	err error
 
+	// flowID is the ID of the sending conn set by the Network layer or
+	// zero if the sending conn is unknown.
+	flowID uint64
+
+	// gro indicates that the Network layer may coalesce datagrams.
+	gro bool
+
 	// localAddr is the local address of the Socket.
 	localAddr netip.AddrPort
 
+	// nonblock indicates that the Network layer should fail
+	// the read rather than blocking it.
+	nonblock bool
+
+	// segments is the number of datagrams read, set by the Network layer.
+	segments int
+
 	// senderAddr is the sender address set by the Network layer.
 	senderAddr netip.AddrPort
+
+	// seq is the datagram sequence number set by the Network layer.
+	seq uint64
+
+	// size is the size of the datagram, set by the Network layer.
+	size int
+
+	// spurious is set by the Network layer when it completes
+	// the read without a datagram (see SetSpuriousWakeups).
+	spurious bool
+
+	// timestamp is the delivery time, set by the Network layer.
+	timestamp time.Time
+
+	// tos is the ToS byte of the datagram, set by the Network layer.
+	tos byte
 }
 
 // loop is the network main loop.
 func (n *Network) loop() {
 	for {
+		// while paused, we stop receiving reads and writes by
+		// selecting on nil channels, which are never ready
+		readUDP, writeUDP := n.readUDP, n.writeUDP
+		if n.paused {
+			readUDP, writeUDP = nil, nil
+		}
+
 		select {
 		case <-n.closed:
 			return
 
 		case req := <-n.newConnUDP:
-			n.onNewConnUDP(req)
+			n.handle(req)
 
-		case req := <-n.readUDP:
-			n.onReadUDP(req)
+		case req := <-readUDP:
+			n.handle(req)
 
-		case req := <-n.writeUDP:
-			n.onWriteUDP(req)
+		case req := <-writeUDP:
+			n.handle(req)
+			n.handleMoreWrites()
 
 		case req := <-n.deleteConnUDP:
-			n.onDeleteConnUDP(req)
+			n.handle(req)
+
+		case req := <-n.cancelReadUDP:
+			n.onCancelReadUDP(req)
+
+		case req := <-n.cancelWriteUDP:
+			n.onCancelWriteUDP(req)
+
+		case req := <-n.rebindUDP:
+			n.onRebindUDP(req)
+
+		case req := <-n.dump:
+			n.onDump(req)
+
+		case req := <-n.waitDrained:
+			n.onWaitDrained(req)
+
+		case req := <-n.stats:
+			n.onStats(req)
+
+		case req := <-n.saveState:
+			n.onSaveState(req)
+
+		case req := <-n.restoreState:
+			n.onRestoreState(req)
+
+		case req := <-n.readErrorQueue:
+			n.onReadErrorQueue(req)
+
+		case req := <-n.lookupConnUDP:
+			n.onLookupConnUDP(req)
+
+		case req := <-n.setPausedUDP:
+			n.onSetPaused(req)
+
+		case req := <-n.setAcceptAnySource:
+			n.onSetAcceptAnySource(req)
+
+		case req := <-n.cancelAllPending:
+			n.onCancelAllPending(req)
+
+		case req := <-n.highWaterMarks:
+			n.onHighWaterMarks(req)
 		}
+
+		// unblock the drain waiters if we delivered everything
+		n.maybeNotifyDrained()
 	}
 }
 
@@ -163,16 +794,75 @@ func (n *Network) onNewConnUDP(req *networkNewConnUDP) {
 	// always acknowledge the caller
 	defer close(req.ack)
 
-	// make sure there is no existing state
-	if n.udp[req.localAddr] != nil {
-		req.err = syscall.EADDRNOTAVAIL
+	// refuse new conns when gracefully closing
+	if n.isDraining() {
+		req.err = net.ErrClosed
+		return
+	}
+
+	// allocate the address when binding to port zero
+	localAddr, err := n.allocateAddr(req.localAddr)
+	if err != nil {
+		req.err = err
+		return
+	}
+	req.localAddr = localAddr
+
+	// give the fault injector a chance to make the bind fail
+	n.mu.Lock()
+	injector := n.bindFaultInjector
+	n.mu.Unlock()
+	if injector != nil {
+		if err := injector(req.localAddr); err != nil {
+			req.err = err
+			return
+		}
+	}
+
+	// take over a conn restored by RestoreState, if any, including its
+	// queued datagrams, otherwise make sure there is no existing state
+	if state := n.udp[req.localAddr]; state != nil {
+		if !state.orphan {
+			req.err = syscall.EADDRNOTAVAIL
+			return
+		}
+		n.nextConnID++
+		state.acceptAnySource = false
+		state.id = n.nextConnID
+		state.orphan = false
+		state.peerAddr = req.peerAddr
+		state.readReady = req.readReady
+		if len(state.blockedWrites) > 0 {
+			state.notifyReadReady()
+		}
+		return
+	}
+
+	// make sure we're not exceeding the maximum number of conns
+	n.mu.Lock()
+	maxConns := n.maxConns
+	n.mu.Unlock()
+	if maxConns > 0 && len(n.udp) >= maxConns {
+		req.err = syscall.EMFILE
 		return
 	}
 
 	// track the new UDP conn
+	n.nextConnID++
 	n.udp[req.localAddr] = &networkConnStateUDP{
-		blockedReads:  []*networkReadUDP{},
-		blockedWrites: []*networkWriteUDP{},
+		acceptAnySource:    false,
+		blockedReads:       []*networkReadUDP{},
+		blockedWrites:      []*networkWriteUDP{},
+		highWaterBytes:     0,
+		highWaterDatagrams: 0,
+		id:                 n.nextConnID,
+		orphan:             false,
+		peerAddr:           req.peerAddr,
+		pendingErr:         nil,
+		queueCredits:       map[int]int{},
+		queuedWrites:       0,
+		readReady:          req.readReady,
+		writeQueues:        map[byte][]*networkWriteUDP{},
 	}
 }
 
@@ -181,41 +871,264 @@ func (n *Network) onReadUDP(read *networkReadUDP) {
 	// get the source socket
 	source := n.udp[read.localAddr]
 
-	// if the source does not exist, this is clearly a bug
-	if source == nil {
+	// fail if the source does not exist, e.g., because RestoreState tore it
+	// down and possibly replaced it with an orphan conn
+	if source == nil || source.orphan {
 		read.err = syscall.EBADF
 		close(read.ack)
 		return
 	}
 
-	// if there are no blocked weites, block this read
+	// if there are no blocked weites, fail a nonblocking read and block
+	// any other read, unless we should simulate a spurious wakeup
+	if len(source.blockedWrites) <= 0 && read.nonblock {
+		read.notifyBlocked(false)
+		read.err = syscall.EAGAIN
+		close(read.ack)
+		return
+	}
+	if len(source.blockedWrites) <= 0 && n.isSpuriousWakeup() {
+		read.notifyBlocked(false)
+		read.spurious = true
+		close(read.ack)
+		return
+	}
 	if len(source.blockedWrites) <= 0 {
 		source.blockedReads = append(source.blockedReads, read)
+		read.blockedOn = source
+		read.notifyBlocked(true)
 		return
 	}
+	read.notifyBlocked(false)
 
-	// get the first blocked write
-	write := source.blockedWrites[0]
-	source.blockedWrites = append([]*networkWriteUDP{}, source.blockedWrites[1:]...)
+	// get the first blocked write with the highest priority and, if the
+	// reader wants GRO, the writes we can coalesce with it. Because we pop
+	// whole writes, a short read discards the rest of the datagram and the
+	// next read returns the following datagram.
+	write := n.popWriteUDP(source)
+	more := n.popCoalescedWritesUDP(read, source, write)
 
 	// invoke common algorithm for readwrite
-	n.finishReadWrite(read, write)
+	n.finishReadWrite(read, write, more...)
+}
+
+// popWriteUDP removes and returns the blocked write of a conn that we should
+// deliver next (see nextWriteUDP). The conn MUST have blocked writes.
+func (n *Network) popWriteUDP(state *networkConnStateUDP) *networkWriteUDP {
+	write := n.nextWriteUDP(state)
+	n.chargeWriteUDP(state, write)
+	state.removeWrite(write)
+	return write
+}
+
+// networkQueueHead is the oldest blocked write of a priority queue.
+type networkQueueHead struct {
+	// weight is the weight of the queue.
+	weight int
+
+	// write is the oldest blocked write of the queue.
+	write *networkWriteUDP
+}
+
+// priorityQueueHeads returns the oldest blocked write of each priority queue
+// with blocked writes, keyed by queue, and the sum of the weights of such queues.
+// We only look at the head of the FIFO of each DSCP value, since the FIFOs of
+// the DSCP values sharing a queue together contain the writes of that queue.
+func (n *Network) priorityQueueHeads(state *networkConnStateUDP) (map[int]networkQueueHead, int) {
+	// the setter replaces rather than mutates the map, so we can safely
+	// use the map after releasing the mutex
+	n.mu.Lock()
+	queues := n.priorityQueues
+	n.mu.Unlock()
+
+	// the key of the shared queue is not a valid DSCP value
+	heads := map[int]networkQueueHead{}
+	for dscp, writes := range state.writeQueues {
+		queue, weight := -1, 1
+		if value, found := queues[dscp]; found && value >= 1 {
+			queue, weight = int(dscp), value
+		}
+		if head, found := heads[queue]; !found || writes[0].queueOrder < head.write.queueOrder {
+			heads[queue] = networkQueueHead{weight: weight, write: writes[0]}
+		}
+	}
+	total := 0
+	for _, head := range heads {
+		total += head.weight
+	}
+	return heads, total
+}
+
+// nextWriteUDP returns the blocked write of a conn that we should deliver next,
+// which is the oldest write of the queue that would have the most credits after
+// adding its weight, breaking ties in favor of the larger weight and then of the
+// older write. This method does not change the credits, which is the job of
+// chargeWriteUDP. The conn MUST have blocked writes.
+func (n *Network) nextWriteUDP(state *networkConnStateUDP) *networkWriteUDP {
+	heads, _ := n.priorityQueueHeads(state)
+	var best networkQueueHead
+	bestCredits, found := 0, false
+	for queue, head := range heads {
+		credits := state.queueCredits[queue] + head.weight
+		if !found || credits > bestCredits || (credits == bestCredits && (head.weight > best.weight ||
+			(head.weight == best.weight && head.write.queueOrder < best.write.queueOrder))) {
+			best, bestCredits, found = head, credits, true
+		}
+	}
+	return best.write
+}
+
+// chargeWriteUDP updates the credits of the priority queues of a conn before we
+// deliver the given blocked write: each queue with blocked writes gains its weight
+// and the queue of the delivered write pays the total weight.
+func (n *Network) chargeWriteUDP(state *networkConnStateUDP, write *networkWriteUDP) {
+	heads, total := n.priorityQueueHeads(state)
+	credits := map[int]int{}
+	for queue, head := range heads {
+		credits[queue] = state.queueCredits[queue] + head.weight
+		if head.write == write {
+			credits[queue] -= total
+		}
+	}
+	state.queueCredits = credits
+}
+
+// pushWrite queues a blocked write at the tail of the blocked writes and
+// of the FIFO of its DSCP value.
+func (state *networkConnStateUDP) pushWrite(write *networkWriteUDP) {
+	state.queuedWrites++
+	write.blockedOn = state
+	write.queueOrder = state.queuedWrites
+	state.blockedWrites = append(state.blockedWrites, write)
+	dscp := write.tos >> 2
+	state.writeQueues[dscp] = append(state.writeQueues[dscp], write)
+}
+
+// removeWrite removes a blocked write, if queued, and returns whether it was queued.
+// This is cheap for the oldest write of each DSCP value, which is the common case.
+func (state *networkConnStateUDP) removeWrite(write *networkWriteUDP) bool {
+	dscp := write.tos >> 2
+	writes, found := removeWriteFrom(state.writeQueues[dscp], write)
+	if !found {
+		return false
+	}
+	if len(writes) > 0 {
+		state.writeQueues[dscp] = writes
+	} else {
+		delete(state.writeQueues, dscp)
+	}
+	state.blockedWrites, _ = removeWriteFrom(state.blockedWrites, write)
+	return true
+}
+
+// clearWrites forgets all the blocked writes.
+func (state *networkConnStateUDP) clearWrites() {
+	state.blockedWrites = []*networkWriteUDP{}
+	state.writeQueues = map[byte][]*networkWriteUDP{}
+}
+
+// removeWriteFrom removes a write from a list of writes, if present, and returns the
+// resulting list and whether the write was present.
+func removeWriteFrom(writes []*networkWriteUDP, write *networkWriteUDP) ([]*networkWriteUDP, bool) {
+	for idx, other := range writes {
+		if other == write {
+			if idx == 0 {
+				return writes[1:], true
+			}
+			return append(writes[:idx], writes[idx+1:]...), true
+		}
+	}
+	return writes, false
+}
+
+// notifyBlocked invokes the block observer, if any.
+func (read *networkReadUDP) notifyBlocked(blocked bool) {
+	if read.blockObserver != nil {
+		read.blockObserver(blocked)
+	}
 }
 
 // onWriteUDP handles a request to write an UDP datagram.
 func (n *Network) onWriteUDP(write *networkWriteUDP) {
+	// refuse new datagrams when gracefully closing
+	if n.isDraining() {
+		write.err = net.ErrClosed
+		close(write.ack)
+		return
+	}
+
+	// report and clear any error caused by a previous ICMP error
+	if source := n.udp[write.boundAddr]; source != nil && source.pendingErr != nil {
+		write.err, source.pendingErr = source.pendingErr, nil
+		close(write.ack)
+		return
+	}
+
+	// assign a sequence number to the datagram
+	n.nextSeq++
+	write.seq = n.nextSeq
+
+	// remember which conn sent the datagram
+	if source := n.udp[write.boundAddr]; source != nil {
+		write.flowID = source.id
+	}
+
+	// make sure the receiver sees a concrete source address
+	selectSourceAddr(write)
+
+	// drop the datagram if the source address is spoofed
+	if n.isSpoofed(write) {
+		n.dropWrite(write, DropReasonSpoofedSource)
+		return
+	}
+
+	// drop the datagram if the destination is blackholed
+	if n.isBlackholed(write.destAddr.Addr()) {
+		n.dropWrite(write, DropReasonBlackhole)
+		return
+	}
+
+	// drop the datagram if it would cross a partition
+	if n.isPartitioned(write.sourceAddr.Addr(), write.destAddr.Addr()) {
+		n.dropWrite(write, DropReasonPartitioned)
+		return
+	}
+
 	// get the destination socket
-	dest := n.udp[write.destAddr]
+	_, dest := n.lookupUDP(write.destAddr)
 
 	// if the dest does not exist, silently drop the datagram.
 	if dest == nil {
-		close(write.ack)
+		n.dropWrite(write, DropReasonNoSuchConn)
+		n.maybePortUnreachable(write)
 		return
 	}
 
-	// if there are no blocked reads, block this write.
+	// a connected dest only accepts datagrams sent by its peer, unless it has
+	// been configured to accept any source, so drop the datagram here rather
+	// than letting a read consume and discard it. We compare addresses rather
+	// than conns, such that a connected conn keeps working when its peer
+	// closes and a new conn binds the same address.
+	if dest.peerAddr.IsValid() && !dest.acceptAnySource && dest.peerAddr != write.sourceAddr {
+		n.dropWrite(write, DropReasonPeerMismatch)
+		return
+	}
+
+	// give the rewriter a chance to modify or drop the datagram
+	if !n.rewritePayload(write) {
+		n.dropWrite(write, DropReasonRewriter)
+		return
+	}
+
+	// if there are no blocked reads, block this write and tell the
+	// conn when it has datagrams to read for the first time.
 	if len(dest.blockedReads) <= 0 {
-		dest.blockedWrites = append(dest.blockedWrites, write)
+		n.maybeMarkCongestion(dest, write)
+		dest.pushWrite(write)
+		dest.updateHighWaterMarks()
+		if len(dest.blockedWrites) == 1 {
+			dest.notifyReadReady()
+		}
 		return
 	}
 
@@ -227,32 +1140,187 @@ func (n *Network) onWriteUDP(write *networkWriteUDP) {
 	n.finishReadWrite(read, write)
 }
 
+// dropWrite drops the datagram of a write for the given reason.
+func (n *Network) dropWrite(write *networkWriteUDP, reason DropReason) {
+	n.drops[reason]++
+	write.dropReason = reason
+	n.ackWrite(write)
+}
+
+// maybePortUnreachable simulates receiving an ICMP port unreachable error for
+// a datagram sent to an address where no conn is bound. Like the kernel, we only
+// report the error to connected conns and we do so using their next write.
+func (n *Network) maybePortUnreachable(write *networkWriteUDP) {
+	n.mu.Lock()
+	enabled := n.icmpErrors
+	n.mu.Unlock()
+	if source := n.udp[write.boundAddr]; enabled && source != nil && source.peerAddr.IsValid() {
+		source.pendingErr = syscall.ECONNREFUSED
+	}
+}
+
+// lookupUDP returns the bound address and the state of the conn that should
+// receive datagrams sent to the given address, which is either the conn bound to
+// the exact address or a conn bound to the wildcard address with the same port
+// and family. The returned state is nil if there is no such conn.
+func (n *Network) lookupUDP(addr netip.AddrPort) (netip.AddrPort, *networkConnStateUDP) {
+	if state := n.udp[addr]; state != nil {
+		return addr, state
+	}
+	wildcard := netip.IPv4Unspecified()
+	if addr.Addr().Is6() {
+		wildcard = netip.IPv6Unspecified()
+	}
+	bound := netip.AddrPortFrom(wildcard, addr.Port())
+	return bound, n.udp[bound]
+}
+
 // finishReadWrite finishes a read and a write.
-func (n *Network) finishReadWrite(read *networkReadUDP, write *networkWriteUDP) {
-	// copy bytes from the writer to the reader
+func (n *Network) finishReadWrite(read *networkReadUDP, write *networkWriteUDP, more ...*networkWriteUDP) {
+	// provide the reader with a buffer if it asked us to
+	if read.borrow {
+		read.buffer = n.getBuffer(len(write.payload))
+	}
+
+	// copy bytes from the writer to the reader, which preserves message
+	// boundaries since each read receives the payload of a single write (or
+	// the whole payloads of the writes coalesced using GRO) and only this
+	// goroutine copies payloads, so concurrent writers to the same
+	// destination can never interleave their bytes
 	read.count = copy(read.buffer, write.payload)
+	read.segments = 1
+	n.logDelivery(write)
 
 	// unblock the writer
-	close(write.ack)
+	n.ackWrite(write)
+
+	// append the payloads of the coalesced writes and unblock their writers
+	for _, other := range more {
+		read.count += copy(read.buffer[read.count:], other.payload)
+		read.segments++
+		n.logDelivery(other)
+		n.ackWrite(other)
+	}
 
-	// take note of the sender
+	// take note of the sender, destination, and size
 	read.senderAddr = write.sourceAddr
+	read.destAddr = write.destAddr
+	read.flowID = write.flowID
+	read.size = len(write.payload) * read.segments
+	read.seq = write.seq
+	read.timestamp = time.Now()
+	read.tos = write.tos
 
 	// unblock the reader
 	close(read.ack)
 }
 
+// onCancelReadUDP handles a request to cancel a blocked read.
+func (n *Network) onCancelReadUDP(req *networkCancelReadUDP) {
+	// always acknowledge the caller
+	defer close(req.ack)
+
+	// the read may have already been completed
+	source := req.read.blockedOn
+	if source == nil {
+		return
+	}
+
+	// forget about the read if it's still blocked
+	for idx, read := range source.blockedReads {
+		if read == req.read {
+			source.blockedReads = append(source.blockedReads[:idx], source.blockedReads[idx+1:]...)
+			return
+		}
+	}
+}
+
+// onCancelWriteUDP handles a request to cancel a blocked write.
+func (n *Network) onCancelWriteUDP(req *networkCancelWriteUDP) {
+	// always acknowledge the caller
+	defer close(req.ack)
+
+	// the write may have already been dropped or delivered
+	dest := req.write.blockedOn
+	if dest == nil {
+		return
+	}
+
+	// forget about the write if it's still blocked
+	dest.removeWrite(req.write)
+}
+
+// onRebindUDP handles a request to move a UDP conn to another address.
+func (n *Network) onRebindUDP(req *networkRebindUDP) {
+	// always acknowledge the caller
+	defer close(req.ack)
+
+	// refuse to move conns when gracefully closing
+	if n.isDraining() {
+		req.err = net.ErrClosed
+		return
+	}
+
+	// fail if the conn does not exist or RestoreState replaced it with an orphan
+	state := n.udp[req.oldAddr]
+	if state == nil || state.orphan {
+		req.err = syscall.EBADF
+		return
+	}
+
+	// allocate the address when binding to port zero
+	newAddr, err := n.allocateAddr(req.newAddr)
+	if err != nil {
+		req.err = err
+		return
+	}
+	req.newAddr = newAddr
+
+	// take over a conn restored by RestoreState, if any, including its
+	// queued datagrams, otherwise make sure the new address is not in use
+	if other := n.udp[req.newAddr]; other != nil {
+		if !other.orphan {
+			req.err = syscall.EADDRINUSE
+			return
+		}
+		n.takeOverOrphanUDP(state, other)
+	}
+
+	// move the state, including queued reads and writes
+	delete(n.udp, req.oldAddr)
+	n.udp[req.newAddr] = state
+}
+
 // onDeleteConnUDP handles a request to forget an existing UDP conn.
 func (n *Network) onDeleteConnUDP(req *networkDeleteConnUDP) {
 	// always acknowledge the caller
 	defer close(req.ack)
 
-	// fail if the destination is not available
-	if n.udp[req.localAddr] == nil {
+	// fail if the destination is not available, including when it is an
+	// orphan, which replaced a conn torn down by RestoreState
+	state := n.udp[req.localAddr]
+	if state == nil || state.orphan {
 		req.err = syscall.EBADF
 		return
 	}
 
 	// forget the existing UDP conn
+	n.teardownConnUDP(state)
 	delete(n.udp, req.localAddr)
 }
+
+// teardownConnUDP drops the datagrams queued for a conn we're about to forget and
+// fails its pending reads.
+func (n *Network) teardownConnUDP(state *networkConnStateUDP) {
+	// drop the datagrams still waiting to be read so they cannot be
+	// delivered to a conn that later binds the same address
+	for _, write := range state.blockedWrites {
+		n.dropWrite(write, DropReasonConnClosed)
+	}
+
+	// fail the reads that are still pending
+	for _, read := range state.blockedReads {
+		read.err = net.ErrClosed
+		close(read.ack)
+	}
+}
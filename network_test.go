@@ -0,0 +1,587 @@
+package netemlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMaxConns(t *testing.T) {
+	n := newTestNetwork(t)
+	n.SetMaxConns(2)
+
+	// open conns up to the limit
+	first := newTestConn(t, n, "10.0.0.1:1", "")
+	newTestConn(t, n, "10.0.0.1:2", "")
+
+	// the next bind must fail
+	_, err := NewUDPConn(n, netip.MustParseAddrPort("10.0.0.1:3"), netip.AddrPort{})
+	if !errors.Is(err, syscall.EMFILE) {
+		t.Fatalf("expected EMFILE, got %v", err)
+	}
+
+	// closing a conn frees a slot
+	first.Close()
+	newTestConn(t, n, "10.0.0.1:3", "")
+}
+
+func TestMaxConnsUnlimited(t *testing.T) {
+	n := newTestNetwork(t)
+	n.SetMaxConns(0)
+	for port := 1; port <= 100; port++ {
+		conn, err := NewUDPConn(n, netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), uint16(port)), netip.AddrPort{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+}
+
+func TestSamePortDistinctAddresses(t *testing.T) {
+	n := newTestNetwork(t)
+	first := newTestConn(t, n, "10.0.0.1:53", "")
+	second := newTestConn(t, n, "10.0.0.2:53", "")
+	wildcard := newTestConn(t, n, "0.0.0.0:53", "")
+	client := newTestConn(t, n, "10.0.0.100:1234", "")
+
+	// each datagram must reach the conn bound to its exact destination
+	for _, tc := range []struct {
+		dest string
+		conn *UDPConn
+	}{
+		{"10.0.0.2:53", second},
+		{"10.0.0.1:53", first},
+		{"10.0.0.3:53", wildcard},
+	} {
+		errch := make(chan error, 1)
+		go func(dest string) {
+			_, err := client.WriteTo([]byte(dest), net.UDPAddrFromAddrPort(netip.MustParseAddrPort(dest)))
+			errch <- err
+		}(tc.dest)
+		mustRead(t, tc.conn, tc.dest)
+		if err := <-errch; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSameAddressTwiceFails(t *testing.T) {
+	n := newTestNetwork(t)
+	newTestConn(t, n, "10.0.0.1:53", "")
+	_, err := NewUDPConn(n, netip.MustParseAddrPort("10.0.0.1:53"), netip.AddrPort{})
+	if !errors.Is(err, syscall.EADDRNOTAVAIL) {
+		t.Fatalf("expected EADDRNOTAVAIL, got %v", err)
+	}
+}
+
+func TestBlackhole(t *testing.T) {
+	n := newTestNetwork(t)
+	n.AddBlackhole(netip.MustParsePrefix("10.0.0.0/24"))
+	sender := newTestConn(t, n, "10.0.1.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+	other := newTestConn(t, n, "10.0.2.2:53", "")
+
+	// datagrams sent to the prefix are dropped even if a conn is bound there
+	if _, err := sender.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if got := n.Stats().Drops[DropReasonBlackhole]; got != 1 {
+		t.Fatalf("expected one blackhole drop, got %d", got)
+	}
+	if err := n.AssertDrained(); err != nil {
+		t.Fatal(err)
+	}
+
+	// datagrams sent outside the prefix are delivered
+	go receiver.WriteTo([]byte("world"), other.LocalAddr())
+	mustRead(t, other, "world")
+}
+
+func TestPartition(t *testing.T) {
+	n := newTestNetwork(t)
+	n.SetPartition(netip.MustParsePrefix("10.0.0.0/24"), netip.MustParsePrefix("10.0.1.0/24"))
+	a1 := newTestConn(t, n, "10.0.0.1:53", "")
+	a2 := newTestConn(t, n, "10.0.0.2:53", "")
+	b1 := newTestConn(t, n, "10.0.1.1:53", "")
+	b2 := newTestConn(t, n, "10.0.1.2:53", "")
+
+	// traffic within each side flows normally
+	writeToAsync(a1, "within a", "10.0.0.2:53")
+	mustRead(t, a2, "within a")
+	writeToAsync(b1, "within b", "10.0.1.2:53")
+	mustRead(t, b2, "within b")
+
+	// traffic across the partition is dropped in both directions
+	if err := <-writeToAsync(a1, "a to b", "10.0.1.1:53"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-writeToAsync(b2, "b to a", "10.0.0.2:53"); err != nil {
+		t.Fatal(err)
+	}
+	if got := n.Stats().Drops[DropReasonPartitioned]; got != 2 {
+		t.Fatalf("expected two partitioned drops, got %d", got)
+	}
+
+	// healing the network restores delivery
+	n.ClearPartitions()
+	writeToAsync(a1, "healed", "10.0.1.1:53")
+	mustRead(t, b1, "healed")
+}
+
+func TestPartitionsCompose(t *testing.T) {
+	n := newTestNetwork(t)
+	n.SetPartition(netip.MustParsePrefix("10.0.0.0/24"), netip.MustParsePrefix("10.0.1.0/24"))
+	n.SetPartition(netip.MustParsePrefix("10.0.0.0/24"), netip.MustParsePrefix("10.0.2.0/24"))
+	a := newTestConn(t, n, "10.0.0.1:53", "")
+	newTestConn(t, n, "10.0.1.1:53", "")
+	newTestConn(t, n, "10.0.2.1:53", "")
+	for _, dest := range []string{"10.0.1.1:53", "10.0.2.1:53"} {
+		if err := <-writeToAsync(a, "lost", dest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := n.Stats().Drops[DropReasonPartitioned]; got != 2 {
+		t.Fatalf("expected two partitioned drops, got %d", got)
+	}
+}
+
+func TestDeletingConnDropsQueuedDatagrams(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "first", "second")
+
+	// closing the receiver drops its datagrams
+	receiver.Close()
+	if got := n.Stats().Drops[DropReasonConnClosed]; got != 2 {
+		t.Fatalf("expected two drops, got %d", got)
+	}
+
+	// a conn binding the same address must not receive them
+	replacement := newTestConn(t, n, "10.0.0.2:53", "")
+	go sender.WriteTo([]byte("third"), replacement.LocalAddr())
+	mustRead(t, replacement, "third")
+}
+
+func TestReversePathFilter(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprint(enabled), func(t *testing.T) {
+			n := newTestNetwork(t)
+			n.SetReversePathFilter(enabled)
+			sender := newTestConn(t, n, "10.0.0.1:1234", "")
+			receiver := newTestConn(t, n, "10.0.0.2:53", "")
+
+			// spoof a source address outside of the bound address
+			spoofed := netip.MustParseAddrPort("10.0.0.9:1234")
+			errch := make(chan error, 1)
+			go func() {
+				_, err := sender.WriteMsgUDPWithSource([]byte("spoofed"), spoofed, netip.MustParseAddrPort("10.0.0.2:53"))
+				errch <- err
+			}()
+
+			if enabled {
+				if err := <-errch; err != nil {
+					t.Fatal(err)
+				}
+				if drops := n.Stats().Drops[DropReasonSpoofedSource]; drops != 1 {
+					t.Fatalf("expected 1 drop, got %d", drops)
+				}
+				return
+			}
+			buffer := make([]byte, 64)
+			count, addr, err := receiver.ReadFrom(buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buffer[:count]) != "spoofed" || addr.String() != spoofed.String() {
+				t.Fatal("unexpected datagram", string(buffer[:count]), addr)
+			}
+			if err := <-errch; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestReversePathFilterAllowsWildcardBind(t *testing.T) {
+	n := newTestNetwork(t)
+	n.SetReversePathFilter(true)
+	sender := newTestConn(t, n, "0.0.0.0:1234", "")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+
+	// any address is fine provided that the port is the bound port
+	go sender.WriteMsgUDPWithSource([]byte("hello"), netip.MustParseAddrPort("10.0.0.1:1234"), netip.MustParseAddrPort("10.0.0.2:53"))
+	mustRead(t, receiver, "hello")
+
+	// a different port is spoofed
+	if _, err := sender.WriteMsgUDPWithSource([]byte("spoofed"), netip.MustParseAddrPort("10.0.0.1:4321"), netip.MustParseAddrPort("10.0.0.2:53")); err != nil {
+		t.Fatal(err)
+	}
+	if drops := n.Stats().Drops[DropReasonSpoofedSource]; drops != 1 {
+		t.Fatalf("expected 1 drop, got %d", drops)
+	}
+}
+
+func TestBatchProcessingPreservesOrder(t *testing.T) {
+	n := newTestNetwork(t)
+	n.SetBatchProcessing(16)
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+
+	// each sender writes a numbered sequence concurrently with the others
+	const senders, count = 8, 50
+	for sidx := 0; sidx < senders; sidx++ {
+		sender := newTestConn(t, n, fmt.Sprintf("10.0.0.1:%d", 1000+sidx), "10.0.0.2:53")
+		go func() {
+			for idx := 0; idx < count; idx++ {
+				if _, err := sender.Write([]byte(fmt.Sprint(idx))); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	// each sender's datagrams must arrive in order
+	next := map[string]int{}
+	buffer := make([]byte, 64)
+	for idx := 0; idx < senders*count; idx++ {
+		size, addr, err := receiver.ReadFrom(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buffer[:size]); got != fmt.Sprint(next[addr.String()]) {
+			t.Fatalf("%s: expected %d, got %s", addr, next[addr.String()], got)
+		}
+		next[addr.String()]++
+	}
+}
+
+func TestBatchProcessingQueuedOrder(t *testing.T) {
+	n := newTestNetwork(t)
+	n.SetBatchProcessing(16)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "a", "b", "c")
+	for _, expect := range []string{"a", "b", "c"} {
+		mustRead(t, receiver, expect)
+	}
+}
+
+// benchmarkBatchProcessing measures the throughput of many concurrent
+// senders writing to a single reader with the given batch size.
+func benchmarkBatchProcessing(b *testing.B, maxBatch int) {
+	n := NewNetwork()
+	defer n.Close()
+	n.SetBatchProcessing(maxBatch)
+	receiver, _ := NewUDPConn(n, netip.MustParseAddrPort("10.0.0.2:53"), netip.AddrPort{})
+	defer receiver.Close()
+
+	payload := make([]byte, 1200)
+	for idx := 0; idx < 16; idx++ {
+		sender, _ := NewUDPConn(n, netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), uint16(1000+idx)), netip.MustParseAddrPort("10.0.0.2:53"))
+		defer sender.Close()
+		go func() {
+			for {
+				if _, err := sender.Write(payload); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	buffer := make([]byte, 1500)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for idx := 0; idx < b.N; idx++ {
+		if _, _, err := receiver.ReadFrom(buffer); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWithoutBatchProcessing(b *testing.B) {
+	benchmarkBatchProcessing(b, 1)
+}
+
+func BenchmarkWithBatchProcessing(b *testing.B) {
+	benchmarkBatchProcessing(b, 16)
+}
+
+func TestBindFaultInjector(t *testing.T) {
+	n := newTestNetwork(t)
+	n.SetBindFaultInjector(func(addr netip.AddrPort) error {
+		if addr.Port() == 443 {
+			return syscall.EACCES
+		}
+		return nil
+	})
+	if _, err := NewUDPConn(n, netip.MustParseAddrPort("10.0.0.1:443"), netip.AddrPort{}); !errors.Is(err, syscall.EACCES) {
+		t.Fatalf("expected EACCES, got %v", err)
+	}
+	newTestConn(t, n, "10.0.0.1:53", "")
+
+	// the failed bind does not leave the address bound
+	n.SetBindFaultInjector(nil)
+	newTestConn(t, n, "10.0.0.1:443", "")
+}
+
+func TestBindFaultInjectorSeesAllocatedPort(t *testing.T) {
+	n := newTestNetwork(t)
+	var ports []uint16
+	n.SetBindFaultInjector(func(addr netip.AddrPort) error {
+		ports = append(ports, addr.Port())
+		return nil
+	})
+	conn := newTestConn(t, n, "10.0.0.1:0", "")
+	if len(ports) != 1 || ports[0] == 0 || conn.LocalAddr().(*net.UDPAddr).Port != int(ports[0]) {
+		t.Fatalf("unexpected ports %v for %v", ports, conn.LocalAddr())
+	}
+}
+
+func TestICMPErrors(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprint(enabled), func(t *testing.T) {
+			n := newTestNetwork(t)
+			n.SetICMPErrors(enabled)
+			client := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+			server := newTestConn(t, n, "10.0.0.2:53", "")
+			if err := server.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// the first write succeeds because the datagram is silently dropped
+			if _, err := client.Write([]byte("first")); err != nil {
+				t.Fatal(err)
+			}
+
+			// the second write reports the port unreachable error, if enabled
+			_, err := client.Write([]byte("second"))
+			if enabled && !errors.Is(err, syscall.ECONNREFUSED) {
+				t.Fatalf("expected ECONNREFUSED, got %v", err)
+			}
+			if !enabled && err != nil {
+				t.Fatal(err)
+			}
+
+			// the error is reported once and the failed write sends nothing
+			if err, ok := client.ReadErrorQueue(); ok {
+				t.Fatalf("expected no pending error, got %v", err)
+			}
+			if _, err := client.Write([]byte("third")); err != nil {
+				t.Fatal(err)
+			}
+
+			// the third write caused another error, which we can pop instead
+			// of having the next write report it
+			if err, ok := client.ReadErrorQueue(); enabled != ok || enabled && !errors.Is(err, syscall.ECONNREFUSED) {
+				t.Fatalf("unexpected pending error %v and %v", err, ok)
+			}
+			if _, err := client.Write([]byte("fourth")); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestICMPErrorsIgnoredByUnconnectedConns(t *testing.T) {
+	n := newTestNetwork(t)
+	n.SetICMPErrors(true)
+	conn := newTestConn(t, n, "10.0.0.1:1234", "")
+	for idx := 0; idx < 2; idx++ {
+		if err := <-writeToAsync(conn, "hello", "10.0.0.2:53"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConcurrentCloseDoesNotBlockOrLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for run := 0; run < 10; run++ {
+		n := NewNetwork()
+		var conns []*UDPConn
+		for idx := 0; idx < 200; idx++ {
+			addr := netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), uint16(1000+idx))
+			conn, err := NewUDPConn(n, addr, netip.AddrPort{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			conns = append(conns, conn)
+
+			// give some conns a pending read that closing must interrupt
+			if idx%2 == 0 {
+				go conn.ReadFrom(make([]byte, 64))
+			}
+		}
+
+		// close the network and the conns concurrently in random order
+		closers := []func() error{n.Close}
+		for _, conn := range conns {
+			closers = append(closers, conn.Close)
+		}
+		rand.Shuffle(len(closers), func(i, j int) {
+			closers[i], closers[j] = closers[j], closers[i]
+		})
+		var wg sync.WaitGroup
+		for _, fn := range closers {
+			wg.Add(1)
+			go func(fn func() error) {
+				defer wg.Done()
+				fn()
+			}(fn)
+		}
+		done := make(chan any)
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("some Close calls are blocked")
+		}
+	}
+
+	// all the goroutines, including the background ones, should exit
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > before; {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines leaked: before %d, after %d", before, runtime.NumGoroutine())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// readAll reads the given number of datagrams and returns their payloads.
+func readAll(t *testing.T, conn *UDPConn, count int) (payloads []string) {
+	t.Helper()
+	buffer := make([]byte, 64)
+	for idx := 0; idx < count; idx++ {
+		size, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, string(buffer[:size]))
+	}
+	return
+}
+
+func TestPriorityQueues(t *testing.T) {
+	n := newTestNetwork(t)
+	const dscpEF = 46
+	n.SetPriorityQueues(map[byte]int{dscpEF: 3})
+	low := newTestConn(t, n, "10.0.0.1:1234", "")
+	high := newTestConn(t, n, "10.0.0.3:1234", "")
+	high.SetTOS(dscpEF << 2)
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+
+	// the high priority datagrams overtake the low priority ones queued earlier
+	queueDatagrams(t, n, low, "10.0.0.2:53", "l0", "l1")
+	queueDatagrams(t, n, high, "10.0.0.2:53", "h0", "h1")
+	if got := fmt.Sprint(readAll(t, receiver, 4)); got != "[h0 h1 l0 l1]" {
+		t.Fatalf("unexpected order %s", got)
+	}
+}
+
+func TestPriorityQueuesAreWeighted(t *testing.T) {
+	n := newTestNetwork(t)
+	const dscpEF = 46
+	n.SetPriorityQueues(map[byte]int{dscpEF: 3})
+	low := newTestConn(t, n, "10.0.0.1:1234", "")
+	high := newTestConn(t, n, "10.0.0.3:1234", "")
+	high.SetTOS(dscpEF << 2)
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+
+	// the low priority queue gets one read out of four while both are backlogged
+	queueDatagrams(t, n, low, "10.0.0.2:53", "l0", "l1", "l2", "l3")
+	queueDatagrams(t, n, high, "10.0.0.2:53", "h0", "h1", "h2", "h3", "h4", "h5", "h6", "h7")
+	expect := "[h0 h1 l0 h2 h3 h4 l1 h5 h6 h7 l2 l3]"
+	if got := fmt.Sprint(readAll(t, receiver, 12)); got != expect {
+		t.Fatalf("expected %s, got %s", expect, got)
+	}
+}
+
+func TestPriorityQueuesDisabled(t *testing.T) {
+	n := newTestNetwork(t)
+	low := newTestConn(t, n, "10.0.0.1:1234", "")
+	high := newTestConn(t, n, "10.0.0.3:1234", "")
+	high.SetTOS(46 << 2)
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+	queueDatagrams(t, n, low, "10.0.0.2:53", "l0")
+	queueDatagrams(t, n, high, "10.0.0.2:53", "h0")
+	queueDatagrams(t, n, low, "10.0.0.2:53", "l1")
+	if got := fmt.Sprint(readAll(t, receiver, 3)); got != "[l0 h0 l1]" {
+		t.Fatalf("unexpected order %s", got)
+	}
+}
+
+func TestPriorityQueuesApplyToQueuedDatagrams(t *testing.T) {
+	n := newTestNetwork(t)
+	low := newTestConn(t, n, "10.0.0.1:1234", "")
+	high := newTestConn(t, n, "10.0.0.3:1234", "")
+	high.SetTOS(46 << 2)
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+	queueDatagrams(t, n, low, "10.0.0.2:53", "l0")
+	queueDatagrams(t, n, high, "10.0.0.2:53", "h0")
+	queueDatagrams(t, n, low, "10.0.0.2:53", "l1")
+
+	// we classify the datagrams when delivering rather than when queueing them
+	n.SetPriorityQueues(map[byte]int{46: 3})
+	if got := fmt.Sprint(readAll(t, receiver, 3)); got != "[h0 l0 l1]" {
+		t.Fatalf("unexpected order %s", got)
+	}
+}
+
+// spuriousWakeupPattern performs several reads on a conn without datagrams and
+// returns a string where S is a spurious wakeup and T is a timeout.
+func spuriousWakeupPattern(t *testing.T, n *Network) string {
+	t.Helper()
+	conn := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	var pattern []byte
+	for idx := 0; idx < 16; idx++ {
+		count, err := conn.ReadWithTimeout(context.Background(), make([]byte, 64), time.Millisecond)
+		switch {
+		case err == nil && count == 0:
+			pattern = append(pattern, 'S')
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			pattern = append(pattern, 'T')
+		default:
+			t.Fatal("unexpected result", count, err)
+		}
+	}
+	return string(pattern)
+}
+
+func TestSpuriousWakeupsAreReproducible(t *testing.T) {
+	first := newTestNetwork(t)
+	first.SetSpuriousWakeups(0.5)
+	first.SetRandomSource(rand.NewSource(1))
+	expect := spuriousWakeupPattern(t, first)
+	if !strings.Contains(expect, "S") || !strings.Contains(expect, "T") {
+		t.Fatalf("expected both outcomes, got %s", expect)
+	}
+
+	second := NewNetworkWithConfig(NetworkConfig{
+		RandomSource:    rand.NewSource(1),
+		SpuriousWakeups: 0.5,
+	})
+	t.Cleanup(func() { second.Close() })
+	if got := spuriousWakeupPattern(t, second); got != expect {
+		t.Fatalf("expected %s, got %s", expect, got)
+	}
+}
+
+func TestSpuriousWakeupsDisabled(t *testing.T) {
+	n := newTestNetwork(t)
+	if got := spuriousWakeupPattern(t, n); got != strings.Repeat("T", 16) {
+		t.Fatalf("unexpected pattern %s", got)
+	}
+}
@@ -0,0 +1,13 @@
+package netemlite
+
+//
+// Nonblocking reads
+//
+
+// SetNonblock controls whether reads fail with [syscall.EAGAIN] when there is no
+// datagram waiting to be read rather than blocking (like setting O_NONBLOCK). This
+// setting only affects reads because writes never wait for buffer space: they wait
+// for a reader to take their datagram, which is how the [Network] works.
+func (c *UDPConn) SetNonblock(enabled bool) {
+	c.nonblock.Store(enabled)
+}
@@ -0,0 +1,86 @@
+package netemlite
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSetNonblock(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	receiver.SetNonblock(true)
+
+	// a read fails when there is nothing to read
+	if _, err := receiver.Read(make([]byte, 64)); !errors.Is(err, syscall.EAGAIN) {
+		t.Fatalf("expected EAGAIN, got %v", err)
+	}
+
+	// a read succeeds when a datagram is waiting
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "hello")
+	mustRead(t, receiver, "hello")
+	if _, err := receiver.Read(make([]byte, 64)); !errors.Is(err, syscall.EAGAIN) {
+		t.Fatalf("expected EAGAIN, got %v", err)
+	}
+
+	// a failed read does not leave a blocked read behind
+	waitBlockedReads(t, n, "10.0.0.2:53", 0)
+
+	// disabling the flag makes reads block again
+	receiver.SetNonblock(false)
+	errch := make(chan error, 1)
+	go func() {
+		_, err := receiver.Read(make([]byte, 64))
+		errch <- err
+	}()
+	waitBlockedReads(t, n, "10.0.0.2:53", 1)
+	writeAsync(sender, "world")
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadReady(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	receiver.SetNonblock(true)
+
+	// there is no notification without datagrams
+	select {
+	case <-receiver.ReadReady():
+		t.Fatal("unexpected notification")
+	default:
+	}
+
+	// we are notified once when the datagrams arrive
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "first", "second")
+	select {
+	case <-receiver.ReadReady():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a notification")
+	}
+	select {
+	case <-receiver.ReadReady():
+		t.Fatal("unexpected second notification")
+	default:
+	}
+
+	// drain the conn until reading would block
+	mustRead(t, receiver, "first")
+	mustRead(t, receiver, "second")
+	if _, err := receiver.Read(make([]byte, 64)); !errors.Is(err, syscall.EAGAIN) {
+		t.Fatalf("expected EAGAIN, got %v", err)
+	}
+
+	// a new datagram produces a new notification
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "third")
+	select {
+	case <-receiver.ReadReady():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a notification")
+	}
+	mustRead(t, receiver, "third")
+}
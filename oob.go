@@ -0,0 +1,155 @@
+package netemlite
+
+//
+// Simulated control messages (aka OOB data)
+//
+// Because there is no kernel involved, we do not use the kernel's cmsg
+// layout. Instead, each control message consists of a one-byte type, a
+// one-byte data length, and the data itself. Use the Parse*OOB functions
+// to extract specific control messages from the OOB data.
+//
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"time"
+)
+
+const (
+	// MsgTrunc is the flag returned by ReadMsgUDP when the datagram
+	// did not fit into the buffer and was thus truncated.
+	MsgTrunc = 1 << iota
+
+	// MsgCtrunc is the flag returned by ReadMsgUDP when some control
+	// messages did not fit into the OOB buffer and were discarded.
+	MsgCtrunc
+)
+
+const (
+	// oobPacketInfo is the type of the message containing the
+	// destination address of a datagram (like IP_PKTINFO).
+	oobPacketInfo = byte(iota + 1)
+
+	// oobTimestamp is the type of the message containing the time
+	// when a datagram was delivered (like SCM_TIMESTAMP).
+	oobTimestamp
+
+	// oobHopLimit is the type of the message containing the TTL or
+	// the hop limit of a datagram (like IP_TTL or IPV6_HOPLIMIT).
+	oobHopLimit
+
+	// oobSegmentSize is the type of the message containing the size
+	// of the datagrams coalesced by a read (like UDP_GRO).
+	oobSegmentSize
+
+	// oobTOS is the type of the message containing the ToS byte
+	// of a datagram (like IP_TOS or IPV6_TCLASS).
+	oobTOS
+)
+
+// defaultHopLimit is the hop limit of received datagrams, which is the initial
+// TTL used by Linux because we do not simulate routers decrementing it.
+const defaultHopLimit = 64
+
+// oobWriter writes control messages into an OOB buffer.
+type oobWriter struct {
+	// buffer is the OOB buffer.
+	buffer []byte
+
+	// flags contains MsgCtrunc if we discarded messages.
+	flags int
+
+	// oobn is the number of bytes written into buffer.
+	oobn int
+}
+
+// append appends a control message or sets MsgCtrunc if it does not fit.
+func (w *oobWriter) append(kind byte, data []byte) {
+	if len(w.buffer)-w.oobn < 2+len(data) {
+		w.flags |= MsgCtrunc
+		return
+	}
+	w.buffer[w.oobn] = kind
+	w.buffer[w.oobn+1] = byte(len(data))
+	copy(w.buffer[w.oobn+2:], data)
+	w.oobn += 2 + len(data)
+}
+
+// oobFind returns the data of the first control message with the given type.
+func oobFind(oob []byte, kind byte) ([]byte, bool) {
+	for len(oob) >= 2 {
+		size := int(oob[1])
+		if len(oob) < 2+size {
+			break
+		}
+		if oob[0] == kind {
+			return oob[2 : 2+size], true
+		}
+		oob = oob[2+size:]
+	}
+	return nil, false
+}
+
+// ParsePacketInfoOOB returns the destination address of a datagram read using
+// ReadMsgUDP with packet info enabled (see [UDPConn.SetReadPacketInfo]).
+func ParsePacketInfoOOB(oob []byte) (netip.AddrPort, bool) {
+	data, found := oobFind(oob, oobPacketInfo)
+	if !found {
+		return netip.AddrPort{}, false
+	}
+	var addr netip.AddrPort
+	if err := addr.UnmarshalBinary(data); err != nil {
+		return netip.AddrPort{}, false
+	}
+	return addr, true
+}
+
+// encodeTimestampOOB encodes the data of a timestamp control message.
+func encodeTimestampOOB(t time.Time) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(t.UnixNano()))
+}
+
+// ParseTimestampOOB returns the delivery time of a datagram read using
+// ReadMsgUDP with timestamps enabled (see [UDPConn.SetReceiveTimestamp]).
+func ParseTimestampOOB(oob []byte) (time.Time, bool) {
+	data, found := oobFind(oob, oobTimestamp)
+	if !found || len(data) != 8 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(data))), true
+}
+
+// ParseHopLimitOOB returns the TTL or hop limit of a datagram read using
+// ReadMsgUDP with hop limits enabled (see [UDPConn.SetReceiveHopLimit]).
+func ParseHopLimitOOB(oob []byte) (int, bool) {
+	data, found := oobFind(oob, oobHopLimit)
+	if !found || len(data) != 1 {
+		return 0, false
+	}
+	return int(data[0]), true
+}
+
+// ParseECNOOB returns the ECN codepoint (e.g., [ECNCE]) of a datagram read using
+// ReadMsgUDP with the ToS byte enabled (see [UDPConn.SetReceiveTOS]).
+func ParseECNOOB(oob []byte) (byte, bool) {
+	data, found := oobFind(oob, oobTOS)
+	if !found || len(data) != 1 {
+		return 0, false
+	}
+	return data[0] & ecnMask, true
+}
+
+// encodeSegmentSizeOOB encodes the data of a segment size control message.
+func encodeSegmentSizeOOB(size int) []byte {
+	return binary.BigEndian.AppendUint16(nil, uint16(size))
+}
+
+// ParseSegmentSizeOOB returns the size of each datagram coalesced by a read
+// using ReadMsgUDPGRO with GRO enabled (see [UDPConn.SetGRO]).
+func ParseSegmentSizeOOB(oob []byte) (int, bool) {
+	data, found := oobFind(oob, oobSegmentSize)
+	if !found || len(data) != 2 {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint16(data)), true
+}
@@ -0,0 +1,130 @@
+package netemlite
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestReadMsgUDPPacketInfo(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "")
+	receiver := newTestConn(t, n, "0.0.0.0:53", "")
+	receiver.SetReadPacketInfo(true)
+
+	writeToAsync(sender, "hello", "10.0.0.2:53")
+	buffer, oob := make([]byte, 64), make([]byte, 64)
+	count, oobn, flags, addr, err := receiver.ReadMsgUDP(buffer, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer[:count]) != "hello" || flags != 0 || addr.String() != "10.0.0.1:1234" {
+		t.Fatal("unexpected result", string(buffer[:count]), flags, addr)
+	}
+	dst, found := ParsePacketInfoOOB(oob[:oobn])
+	if !found || dst != netip.MustParseAddrPort("10.0.0.2:53") {
+		t.Fatal("unexpected packet info", dst, found)
+	}
+}
+
+func TestReadMsgUDPTruncation(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+	receiver.SetReadPacketInfo(true)
+
+	// a small buffer truncates the datagram and a small OOB buffer
+	// causes us to discard the control messages
+	writeAsync(sender, "hello, world")
+	buffer, oob := make([]byte, 5), make([]byte, 2)
+	count, oobn, flags, _, err := receiver.ReadMsgUDP(buffer, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer[:count]) != "hello" || oobn != 0 || flags != MsgTrunc|MsgCtrunc {
+		t.Fatal("unexpected result", string(buffer[:count]), oobn, flags)
+	}
+}
+
+func TestReadMsgUDPWithoutControlMessages(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+
+	writeAsync(sender, "hello")
+	count, oobn, flags, _, err := receiver.ReadMsgUDP(make([]byte, 64), make([]byte, 64))
+	if err != nil || count != 5 || oobn != 0 || flags != 0 {
+		t.Fatal("unexpected result", count, oobn, flags, err)
+	}
+	if _, found := ParsePacketInfoOOB(nil); found {
+		t.Fatal("found packet info in empty OOB data")
+	}
+}
+
+func TestReadMsgUDPTimestamp(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	receiver.SetReceiveTimestamp(true)
+
+	// the timestamp is the delivery time rather than the send time
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "hello")
+	time.Sleep(20 * time.Millisecond)
+	before := time.Now()
+	buffer, oob := make([]byte, 64), make([]byte, 64)
+	_, oobn, _, _, err := receiver.ReadMsgUDP(buffer, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now()
+	timestamp, found := ParseTimestampOOB(oob[:oobn])
+	if !found || timestamp.Before(before) || timestamp.After(after) {
+		t.Fatal("unexpected timestamp", timestamp, found, before, after)
+	}
+}
+
+func TestParseTimestampOOBMissing(t *testing.T) {
+	if _, found := ParseTimestampOOB(nil); found {
+		t.Fatal("expected no timestamp")
+	}
+}
+
+func TestReadMsgUDPHopLimit(t *testing.T) {
+	for _, family := range []struct {
+		sender, receiver string
+	}{
+		{sender: "10.0.0.1:1234", receiver: "10.0.0.2:53"},
+		{sender: "[::1]:1234", receiver: "[::2]:53"},
+	} {
+		n := newTestNetwork(t)
+		sender := newTestConn(t, n, family.sender, family.receiver)
+		receiver := newTestConn(t, n, family.receiver, family.sender)
+		receiver.SetReceiveHopLimit(true)
+
+		// there are no routers, so the hop limit is the initial one
+		writeAsync(sender, "hello")
+		buffer, oob := make([]byte, 64), make([]byte, 64)
+		_, oobn, _, _, err := receiver.ReadMsgUDP(buffer, oob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hopLimit, found := ParseHopLimitOOB(oob[:oobn]); !found || hopLimit != 64 {
+			t.Fatal("unexpected hop limit", hopLimit, found)
+		}
+	}
+}
+
+func TestReadMsgUDPHopLimitDisabled(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	writeAsync(sender, "hello")
+	buffer, oob := make([]byte, 64), make([]byte, 64)
+	_, oobn, _, _, err := receiver.ReadMsgUDP(buffer, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := ParseHopLimitOOB(oob[:oobn]); found {
+		t.Fatal("expected no hop limit")
+	}
+}
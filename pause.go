@@ -0,0 +1,60 @@
+package netemlite
+
+//
+// Pausing and resuming delivery
+//
+
+// networkSetPaused is a request to pause or resume delivery.
+type networkSetPaused struct {
+	// ack is closed by the Network layer to acknowledge that
+	// it has processed this message.
+	ack chan any
+
+	// paused indicates whether to pause delivery.
+	paused bool
+}
+
+// Pause freezes delivery: until you call Resume, the network stops servicing
+// reads and writes, which block inside the caller (still honoring deadlines and
+// closes), while binds, closes, and inspection methods such as [Network.Dump]
+// keep working. This allows creating deterministic windows in which nothing moves.
+// When this method returns, the network has stopped servicing reads and writes.
+func (n *Network) Pause() {
+	n.setPaused(true)
+}
+
+// Resume resumes delivery after Pause. The reads and writes issued while the
+// network was paused proceed as if they had been issued just now.
+func (n *Network) Resume() {
+	n.setPaused(false)
+}
+
+// setPaused pauses or resumes delivery using the background goroutine.
+func (n *Network) setPaused(paused bool) {
+	req := &networkSetPaused{
+		ack:    make(chan any),
+		paused: paused,
+	}
+	select {
+	case <-n.closed:
+		// nothing
+
+	case n.setPausedUDP <- req:
+		select {
+		case <-n.closed:
+			// nothing
+
+		case <-req.ack:
+			// nothing
+		}
+	}
+}
+
+// onSetPaused handles a request to pause or resume delivery.
+func (n *Network) onSetPaused(req *networkSetPaused) {
+	// always acknowledge the caller
+	defer close(req.ack)
+
+	// the main loop stops receiving reads and writes while paused
+	n.paused = req.paused
+}
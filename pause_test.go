@@ -0,0 +1,60 @@
+package netemlite
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPauseAndResume(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	n.Pause()
+
+	// neither the write nor the read complete while paused
+	errch := writeAsync(sender, "hello")
+	readch := make(chan string, 1)
+	go func() {
+		buffer := make([]byte, 64)
+		count, _ := receiver.Read(buffer)
+		readch <- string(buffer[:count])
+	}()
+	select {
+	case err := <-errch:
+		t.Fatalf("unexpected write completion: %v", err)
+	case got := <-readch:
+		t.Fatalf("unexpected read completion: %q", got)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// binds and inspection keep working while paused
+	newTestConn(t, n, "10.0.0.3:53", "")
+	if conns := n.Dump().Conns; len(conns) != 3 {
+		t.Fatalf("expected 3 conns, got %d", len(conns))
+	}
+	if conns := n.Dump().Conns; conns[1].BlockedReads != 0 || conns[1].BlockedWrites != 0 {
+		t.Fatalf("unexpected queued operations %+v", conns[1])
+	}
+
+	n.Resume()
+	if got := <-readch; got != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", got)
+	}
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPausedWriteHonorsDeadline(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	n.Pause()
+	defer n.Resume()
+	sender.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := sender.Write([]byte("hello")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected ErrDeadlineExceeded, got %v", err)
+	}
+}
@@ -0,0 +1,26 @@
+package netemlite
+
+//
+// Pool of buffers for borrowed reads
+//
+
+import "sync"
+
+// getBuffer returns a buffer from the pool with at least the given size.
+func (n *Network) getBuffer(size int) []byte {
+	if bp, ok := n.buffers.Get().(*[]byte); ok && cap(*bp) >= size {
+		return (*bp)[:size]
+	}
+	return make([]byte, size)
+}
+
+// releaseFunc returns a function that puts the buffer back into the pool. The
+// returned function is idempotent, so calling it more than once is harmless.
+func (n *Network) releaseFunc(buffer []byte) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			n.buffers.Put(&buffer)
+		})
+	}
+}
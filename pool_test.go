@@ -0,0 +1,126 @@
+package netemlite
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReadBorrow(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+
+	// the borrowed payload must contain the datagram
+	writeAsync(sender, "hello, world")
+	payload, addr, release, err := receiver.ReadBorrow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != "hello, world" || addr.String() != "10.0.0.1:1234" {
+		t.Fatal("unexpected payload or address", string(payload), addr)
+	}
+	release()
+	release() // must be idempotent
+}
+
+func TestReadBorrowReusesBuffers(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+
+	// a sync.Pool may drop buffers, so we only require some reuse
+	var previous *byte
+	reused := false
+	for idx := 0; idx < 100 && !reused; idx++ {
+		expect := bytes.Repeat([]byte{byte(idx)}, 512)
+		go sender.Write(expect)
+		payload, _, release, err := receiver.ReadBorrow()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(payload, expect) {
+			t.Fatal("unexpected payload")
+		}
+		reused = previous == &payload[0]
+		previous = &payload[0]
+		release()
+	}
+	if !reused {
+		t.Fatal("the pool never reused a buffer")
+	}
+}
+
+// benchmarkRead measures reading datagrams using the given read function.
+func benchmarkRead(b *testing.B, read func(conn *UDPConn) error) {
+	n := NewNetwork()
+	defer n.Close()
+	sender, _ := NewUDPConn(n, netip.MustParseAddrPort("10.0.0.1:1234"), netip.MustParseAddrPort("10.0.0.2:53"))
+	defer sender.Close()
+	receiver, _ := NewUDPConn(n, netip.MustParseAddrPort("10.0.0.2:53"), netip.MustParseAddrPort("10.0.0.1:1234"))
+	defer receiver.Close()
+
+	payload := make([]byte, 1200)
+	go func() {
+		for {
+			if _, err := sender.Write(payload); err != nil {
+				return
+			}
+		}
+	}()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for idx := 0; idx < b.N; idx++ {
+		if err := read(receiver); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	buffer := make([]byte, 1500)
+	benchmarkRead(b, func(conn *UDPConn) error {
+		_, err := conn.Read(buffer)
+		return err
+	})
+}
+
+func BenchmarkReadBorrow(b *testing.B) {
+	benchmarkRead(b, func(conn *UDPConn) error {
+		_, _, release, err := conn.ReadBorrow()
+		if err == nil {
+			release()
+		}
+		return err
+	})
+}
+
+func TestWriteNextTo(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	writeAsync(sender, "hello, world")
+	var buffer bytes.Buffer
+	count, err := receiver.WriteNextTo(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 12 || buffer.String() != "hello, world" {
+		t.Fatalf("unexpected result %d %q", count, buffer.String())
+	}
+}
+
+func TestWriteNextToDeadline(t *testing.T) {
+	n := newTestNetwork(t)
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	receiver.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	var buffer bytes.Buffer
+	if _, err := receiver.WriteNextTo(&buffer); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected ErrDeadlineExceeded, got %v", err)
+	}
+}
@@ -0,0 +1,25 @@
+package netemlite
+
+//
+// Readiness notifications
+//
+
+// ReadReady returns a channel that receives a value when the conn has datagrams to
+// read, which allows event-loop code to wait for readiness and then perform
+// nonblocking reads (see SetNonblock). Like edge-triggered epoll, we only notify
+// when the conn goes from having no datagrams to read to having some, so you
+// should read until the read fails with [syscall.EAGAIN] before waiting again. A
+// notification does not guarantee that a read succeeds, since the datagrams may
+// go away in the meanwhile, e.g., because the writer's deadline expired.
+func (c *UDPConn) ReadReady() <-chan struct{} {
+	return c.readReady
+}
+
+// notifyReadReady notifies the [UDPConn], if any, that there are datagrams to
+// read without blocking when a previous notification is still pending.
+func (state *networkConnStateUDP) notifyReadReady() {
+	select {
+	case state.readReady <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,64 @@
+package netemlite
+
+//
+// Bidirectional relay between conns
+//
+
+import (
+	"sync"
+	"syscall"
+)
+
+// Relay forwards datagrams from a to b and from b to a until either conn is
+// closed or an I/O error occurs. Both conns should be connected, since Relay
+// uses Read and Write. Relay forwards empty datagrams but not the spurious wakeups
+// simulated using [Network.SetSpuriousWakeups]. On return, both conns are closed and Relay returns the
+// first error that stopped forwarding, which is [net.ErrClosed] when the
+// relay stops because someone closed one of the conns.
+func Relay(a, b *UDPConn) error {
+	var (
+		first error
+		once  sync.Once
+		wg    sync.WaitGroup
+	)
+
+	// stop records the first error and interrupts the other goroutine
+	stop := func(err error) {
+		once.Do(func() {
+			first = err
+			a.Close()
+			b.Close()
+		})
+	}
+
+	wg.Add(2)
+	go relayForward(&wg, a, b, stop)
+	go relayForward(&wg, b, a, stop)
+	wg.Wait()
+	return first
+}
+
+// relayForward forwards datagrams from src to dst until an error occurs.
+func relayForward(wg *sync.WaitGroup, src, dst *UDPConn, stop func(err error)) {
+	defer wg.Done()
+	// make sure we're connected like Read does
+	if !src.peerAddr.IsValid() {
+		stop(syscall.ENOTCONN)
+		return
+	}
+
+	buffer := make([]byte, 1<<16)
+	for {
+		// a spurious wakeup returns no data like an empty datagram, so we
+		// cannot use Read without forwarding spurious empty datagrams
+		req := src.newReadRequest(buffer)
+		if err := src.issueReadSkippingSpurious(req); err != nil {
+			stop(err)
+			return
+		}
+		if _, err := dst.Write(buffer[:req.count]); err != nil {
+			stop(err)
+			return
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package netemlite
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRelay(t *testing.T) {
+	n := newTestNetwork(t)
+	client := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.3:53")
+	front := newTestConn(t, n, "10.0.0.3:53", "10.0.0.1:1234")
+	back := newTestConn(t, n, "10.0.0.3:5000", "10.0.0.2:7")
+	server := newTestConn(t, n, "10.0.0.2:7", "10.0.0.3:5000")
+
+	// echo datagrams back to the relay
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			count, err := server.Read(buffer)
+			if err != nil {
+				return
+			}
+			if _, err := server.Write(buffer[:count]); err != nil {
+				return
+			}
+		}
+	}()
+
+	relayErr := make(chan error, 1)
+	go func() {
+		relayErr <- Relay(front, back)
+	}()
+
+	for _, payload := range []string{"hello", "world"} {
+		errch := writeAsync(client, payload)
+		mustRead(t, client, payload)
+		if err := <-errch; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// closing one conn stops the relay and closes the other conn
+	front.Close()
+	select {
+	case err := <-relayErr:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("expected ErrClosed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the relay did not stop")
+	}
+	if _, err := back.Write([]byte("hello")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestRelaySkipsSpuriousWakeups(t *testing.T) {
+	n := newTestNetwork(t)
+	n.SetSpuriousWakeups(1)
+	client := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.3:53")
+	front := newTestConn(t, n, "10.0.0.3:53", "10.0.0.1:1234")
+	back := newTestConn(t, n, "10.0.0.3:5000", "10.0.0.2:7")
+	server := newTestConn(t, n, "10.0.0.2:7", "10.0.0.3:5000")
+
+	// send the datagram only after the relay has woken up spuriously
+	wakeup := make(chan struct{}, 1)
+	front.SetReadBlockObserver(func(blocked bool) {
+		select {
+		case wakeup <- struct{}{}:
+		default:
+		}
+	})
+	relayErr := make(chan error, 1)
+	go func() {
+		relayErr <- Relay(front, back)
+	}()
+	go func() {
+		<-wakeup
+		client.Write([]byte("hello"))
+	}()
+
+	// the server must not receive empty datagrams caused by the wakeups
+	message, err := NewFramedConn(server).ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(message) != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", message)
+	}
+	front.Close()
+	<-relayErr
+}
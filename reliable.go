@@ -0,0 +1,78 @@
+package netemlite
+
+//
+// Request/response exchanges with retransmissions
+//
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ReliableDatagram performs DNS-like or NTP-like request/response exchanges over a
+// connected [UDPConn]: it sends a request, waits for the response until a timeout
+// expires, and retransmits the request doubling the timeout each time, until it
+// receives a response or has made the configured number of attempts. The zero value
+// is invalid; use [NewReliableDatagram] to construct.
+type ReliableDatagram struct {
+	// attempts is the READONLY maximum number of times we send a request.
+	attempts int
+
+	// conn is the READONLY underlying conn.
+	conn *UDPConn
+
+	// timeout is the READONLY timeout of the first attempt.
+	timeout time.Duration
+}
+
+// NewReliableDatagram creates a [ReliableDatagram] using the given connected conn,
+// the timeout of the first attempt, and the maximum number of attempts. Because
+// RoundTrip reads the response from the conn, you should not read concurrently.
+func NewReliableDatagram(conn *UDPConn, timeout time.Duration, attempts int) *ReliableDatagram {
+	return &ReliableDatagram{
+		attempts: attempts,
+		conn:     conn,
+		timeout:  timeout,
+	}
+}
+
+// RoundTrip sends the request, reads the response into the given buffer, and returns
+// the number of bytes read along with the RTT. Because the network delivers a datagram
+// only when the peer reads it, we count a request the peer does not read in time as
+// lost. The first datagram we receive is the response, even if the peer sent it in
+// reply to a previous transmission, and we measure the RTT from the last transmission,
+// so the RTT may be underestimated after a retransmission. When all the attempts time
+// out, this method fails with [os.ErrDeadlineExceeded]. We implement the timeouts
+// without modifying the deadlines of the conn, which still apply. This method fails
+// with [syscall.EINVAL] if the timeout is not positive or there are no attempts.
+func (r *ReliableDatagram) RoundTrip(request, response []byte) (int, time.Duration, error) {
+	// a zero timeout would otherwise disable the timeouts of the attempts
+	if r.timeout <= 0 || r.attempts < 1 {
+		return 0, 0, syscall.EINVAL
+	}
+
+	timeout := r.timeout
+	for attempt := 0; attempt < r.attempts; attempt++ {
+		// send the request unless the peer does not read it in time
+		sent := time.Now()
+		if _, err := r.conn.writeWithTimeout(request, timeout); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			return 0, 0, err
+		}
+
+		// wait for the response until the attempt times out
+		if remaining := timeout - time.Since(sent); remaining > 0 {
+			count, err := r.conn.ReadWithTimeout(context.Background(), response, remaining)
+			if err == nil {
+				return count, time.Since(sent), nil
+			}
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				return 0, 0, err
+			}
+		}
+		timeout *= 2
+	}
+	return 0, 0, os.ErrDeadlineExceeded
+}
@@ -0,0 +1,112 @@
+package netemlite
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startEchoServer echoes each datagram back to its sender in the background
+// until the conn is closed.
+func startEchoServer(server *UDPConn) {
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			count, addr, err := server.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			server.WriteTo(buffer[:count], addr)
+		}
+	}()
+}
+
+func TestReliableDatagramLossyLink(t *testing.T) {
+	n := newTestNetwork(t)
+	useLossyLink(n, 0.3)
+	startEchoServer(newTestConn(t, n, "10.0.0.2:7", ""))
+
+	// use a new client each time, such that a late reply to
+	// a previous exchange cannot be mistaken for the response
+	for idx := 0; idx < 10; idx++ {
+		client := newTestConn(t, n, fmt.Sprintf("10.0.0.1:%d", 1000+idx), "10.0.0.2:7")
+		rd := NewReliableDatagram(client, 10*time.Millisecond, 20)
+		response := make([]byte, 64)
+		count, rtt, err := rd.RoundTrip([]byte("hello"), response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(response[:count]) != "hello" || rtt <= 0 {
+			t.Fatalf("unexpected response %q and RTT %v", response[:count], rtt)
+		}
+		client.Close()
+	}
+}
+
+func TestReliableDatagramTimeout(t *testing.T) {
+	n := newTestNetwork(t)
+	newTestConn(t, n, "10.0.0.2:7", "")
+	client := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:7")
+
+	// the peer never reads, so each attempt waits for twice as long
+	rd := NewReliableDatagram(client, 10*time.Millisecond, 3)
+	start := time.Now()
+	if _, _, err := rd.RoundTrip([]byte("hello"), make([]byte, 64)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected ErrDeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 70*time.Millisecond {
+		t.Fatalf("expected at least 70ms, got %v", elapsed)
+	}
+}
+
+func TestReliableDatagramKeepsDefaultDeadlines(t *testing.T) {
+	n := newTestNetwork(t)
+	n.SetDefaultDeadlines(50*time.Millisecond, 50*time.Millisecond)
+	startEchoServer(newTestConn(t, n, "10.0.0.2:7", ""))
+	client := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:7")
+	rd := NewReliableDatagram(client, 10*time.Millisecond, 3)
+	if _, _, err := rd.RoundTrip([]byte("hello"), make([]byte, 64)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the default read timeout still applies after the exchange
+	errch := make(chan error, 1)
+	go func() {
+		_, err := client.Read(make([]byte, 64))
+		errch <- err
+	}()
+	select {
+	case err := <-errch:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("expected ErrDeadlineExceeded, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the default read timeout was cleared")
+	}
+}
+
+func TestReliableDatagramUnconnected(t *testing.T) {
+	n := newTestNetwork(t)
+	conn := newTestConn(t, n, "10.0.0.1:1234", "")
+	rd := NewReliableDatagram(conn, 10*time.Millisecond, 3)
+	if _, _, err := rd.RoundTrip([]byte("hello"), make([]byte, 64)); !errors.Is(err, syscall.ENOTCONN) {
+		t.Fatalf("expected ENOTCONN, got %v", err)
+	}
+}
+
+func TestReliableDatagramInvalidConfig(t *testing.T) {
+	n := newTestNetwork(t)
+	conn := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	for _, rd := range []*ReliableDatagram{
+		NewReliableDatagram(conn, 0, 3),
+		NewReliableDatagram(conn, -time.Second, 3),
+		NewReliableDatagram(conn, 10*time.Millisecond, 0),
+	} {
+		if _, _, err := rd.RoundTrip([]byte("hello"), make([]byte, 64)); !errors.Is(err, syscall.EINVAL) {
+			t.Fatalf("expected EINVAL, got %v", err)
+		}
+	}
+}
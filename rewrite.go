@@ -0,0 +1,58 @@
+package netemlite
+
+//
+// Rewriting payloads in flight
+//
+
+import "net/netip"
+
+// CapturedPacket describes a datagram traveling through the [Network].
+type CapturedPacket struct {
+	// DestAddr is the destination address.
+	DestAddr netip.AddrPort
+
+	// Payload is a copy of the payload, which you may modify.
+	Payload []byte
+
+	// Seq is the sequence number assigned by the network.
+	Seq uint64
+
+	// SourceAddr is the source address.
+	SourceAddr netip.AddrPort
+}
+
+// SetPayloadRewriter sets the function called for each datagram about to be queued
+// for delivery to a conn, which allows tampering with datagrams or simulating
+// transparent proxies. The function receives a copy of the datagram, so the sender's
+// buffer is never modified, and returns the payload to deliver or nil to drop the
+// datagram, which we count as [DropReasonRewriter]. Use the addresses to target
+// specific flows. The function runs in the background goroutine of the network and
+// MUST NOT block or call methods that wait for that goroutine, such as Stats,
+// otherwise the network hangs. A nil value disables rewriting.
+func (n *Network) SetPayloadRewriter(fn func(pkt CapturedPacket) []byte) {
+	n.mu.Lock()
+	n.payloadRewriter = fn
+	n.mu.Unlock()
+}
+
+// rewritePayload invokes the payload rewriter, if any, and returns false if
+// the rewriter wants us to drop the datagram.
+func (n *Network) rewritePayload(write *networkWriteUDP) bool {
+	n.mu.Lock()
+	fn := n.payloadRewriter
+	n.mu.Unlock()
+	if fn == nil {
+		return true
+	}
+	payload := fn(CapturedPacket{
+		DestAddr:   write.destAddr,
+		Payload:    append([]byte{}, write.payload...),
+		Seq:        write.seq,
+		SourceAddr: write.sourceAddr,
+	})
+	if payload == nil {
+		return false
+	}
+	write.payload = payload
+	return true
+}
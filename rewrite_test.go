@@ -0,0 +1,53 @@
+package netemlite
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPayloadRewriter(t *testing.T) {
+	n := newTestNetwork(t)
+	n.SetPayloadRewriter(func(pkt CapturedPacket) []byte {
+		switch pkt.DestAddr.String() {
+		case "10.0.0.2:53":
+			// modifying the copy in place must not affect the sender
+			copy(pkt.Payload, "J")
+			return append(pkt.Payload, " (tampered)"...)
+		case "10.0.0.4:53":
+			return nil
+		default:
+			return pkt.Payload
+		}
+	})
+	sender := newTestConn(t, n, "10.0.0.1:1234", "")
+	tampered := newTestConn(t, n, "10.0.0.2:53", "")
+	untouched := newTestConn(t, n, "10.0.0.3:53", "")
+	newTestConn(t, n, "10.0.0.4:53", "")
+
+	// datagrams to the targeted destination are rewritten
+	payload := []byte("hello")
+	errch := make(chan error, 1)
+	go func() {
+		_, err := sender.WriteTo(payload, tampered.LocalAddr())
+		errch <- err
+	}()
+	mustRead(t, tampered, "Jello (tampered)")
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, []byte("hello")) {
+		t.Fatalf("the sender's buffer was modified: %q", payload)
+	}
+
+	// other flows are untouched
+	writeToAsync(sender, "hello", "10.0.0.3:53")
+	mustRead(t, untouched, "hello")
+
+	// returning nil drops the datagram
+	if err := <-writeToAsync(sender, "dropped", "10.0.0.4:53"); err != nil {
+		t.Fatal(err)
+	}
+	if got := n.Stats().Drops[DropReasonRewriter]; got != 1 {
+		t.Fatalf("expected one rewriter drop, got %d", got)
+	}
+}
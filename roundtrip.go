@@ -0,0 +1,40 @@
+package netemlite
+
+//
+// Synchronous request-response helper
+//
+
+import (
+	"net/netip"
+	"time"
+)
+
+// RoundTrip binds a conn at src connected to dst, sends the payload, and returns
+// the first reply received from dst. The whole operation must complete within
+// the given timeout, otherwise RoundTrip fails with [os.ErrDeadlineExceeded].
+func (n *Network) RoundTrip(src, dst netip.AddrPort, payload []byte, timeout time.Duration) ([]byte, error) {
+	// create the connected conn
+	conn, err := NewUDPConn(n, src, dst)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// bound the duration of the whole exchange
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	// send the request
+	if _, err := conn.Write(payload); err != nil {
+		return nil, err
+	}
+
+	// receive the reply
+	buffer := make([]byte, 1<<16)
+	count, err := conn.Read(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return buffer[:count], nil
+}
@@ -0,0 +1,42 @@
+package netemlite
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	n := newTestNetwork(t)
+	server := newTestConn(t, n, "10.0.0.2:7", "")
+
+	// echo a single datagram back to its sender
+	go func() {
+		buffer := make([]byte, 1024)
+		count, addr, err := server.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		server.WriteTo(buffer[:count], addr)
+	}()
+
+	src, dst := netip.MustParseAddrPort("10.0.0.1:1234"), netip.MustParseAddrPort("10.0.0.2:7")
+	reply, err := n.RoundTrip(src, dst, []byte("hello"), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "hello" {
+		t.Fatalf("unexpected reply %q", reply)
+	}
+}
+
+func TestRoundTripTimeout(t *testing.T) {
+	n := newTestNetwork(t)
+	newTestConn(t, n, "10.0.0.2:7", "")
+	src, dst := netip.MustParseAddrPort("10.0.0.1:1234"), netip.MustParseAddrPort("10.0.0.2:7")
+	if _, err := n.RoundTrip(src, dst, []byte("hello"), 10*time.Millisecond); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected ErrDeadlineExceeded, got %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package netemlite
+
+//
+// Inspecting delivery rules
+//
+
+import "net/netip"
+
+// networkLookupConnUDP is a request to find the conn receiving the datagrams
+// sent to a given address.
+type networkLookupConnUDP struct {
+	// ack is closed by the Network layer to acknowledge that
+	// it has processed this message.
+	ack chan any
+
+	// addr is the address to lookup.
+	addr netip.AddrPort
+
+	// bound is the address of the conn set by the Network layer.
+	bound netip.AddrPort
+
+	// found is set by the Network layer when a conn would receive
+	// the datagrams sent to addr.
+	found bool
+}
+
+// RouteLookup returns the address of the conn that would receive a datagram sent to
+// the given destination address, using the same rules as the background goroutine:
+// the conn bound to the exact address, otherwise the conn bound to the wildcard
+// address of the same family and with the same port. The ok return value is false
+// if there is no such conn, the destination is blackholed, or the network is closed.
+func (n *Network) RouteLookup(dst netip.AddrPort) (bound netip.AddrPort, ok bool) {
+	req := &networkLookupConnUDP{
+		ack:   make(chan any),
+		addr:  dst,
+		bound: netip.AddrPort{},
+		found: false,
+	}
+	select {
+	case <-n.closed:
+		return netip.AddrPort{}, false
+
+	case n.lookupConnUDP <- req:
+		select {
+		case <-n.closed:
+			return netip.AddrPort{}, false
+
+		case <-req.ack:
+			return req.bound, req.found
+		}
+	}
+}
+
+// isRoutable returns whether a conn would receive the datagrams sent to addr.
+func (n *Network) isRoutable(addr netip.AddrPort) bool {
+	_, found := n.RouteLookup(addr)
+	return found
+}
+
+// onLookupConnUDP handles a request to find the conn receiving the datagrams
+// sent to a given address.
+func (n *Network) onLookupConnUDP(req *networkLookupConnUDP) {
+	// always acknowledge the caller
+	defer close(req.ack)
+
+	// blackholed datagrams never reach the conn
+	if n.isBlackholed(req.addr.Addr()) {
+		return
+	}
+
+	if bound, state := n.lookupUDP(req.addr); state != nil {
+		req.bound, req.found = bound, true
+	}
+}
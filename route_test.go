@@ -0,0 +1,56 @@
+package netemlite
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestRouteLookup(t *testing.T) {
+	n := newTestNetwork(t)
+	newTestConn(t, n, "10.0.0.1:53", "")
+	newTestConn(t, n, "0.0.0.0:53", "")
+	newTestConn(t, n, "[::]:443", "")
+	n.AddBlackhole(netip.MustParsePrefix("10.0.1.0/24"))
+
+	cases := []struct {
+		dst   string
+		bound string
+		ok    bool
+	}{{
+		dst:   "10.0.0.1:53",
+		bound: "10.0.0.1:53",
+		ok:    true,
+	}, {
+		dst:   "10.0.0.2:53",
+		bound: "0.0.0.0:53",
+		ok:    true,
+	}, {
+		dst:   "[2001:db8::1]:443",
+		bound: "[::]:443",
+		ok:    true,
+	}, {
+		dst: "10.0.0.2:443",
+		ok:  false,
+	}, {
+		dst: "[2001:db8::1]:53",
+		ok:  false,
+	}, {
+		dst: "10.0.1.1:53",
+		ok:  false,
+	}}
+	for _, tc := range cases {
+		bound, ok := n.RouteLookup(netip.MustParseAddrPort(tc.dst))
+		if ok != tc.ok || (ok && bound.String() != tc.bound) {
+			t.Fatalf("%s: expected %s and %v, got %s and %v", tc.dst, tc.bound, tc.ok, bound, ok)
+		}
+	}
+}
+
+func TestRouteLookupClosedNetwork(t *testing.T) {
+	n := newTestNetwork(t)
+	newTestConn(t, n, "10.0.0.1:53", "")
+	n.Close()
+	if _, ok := n.RouteLookup(netip.MustParseAddrPort("10.0.0.1:53")); ok {
+		t.Fatal("expected no route on a closed network")
+	}
+}
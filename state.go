@@ -0,0 +1,240 @@
+package netemlite
+
+//
+// Saving and restoring the network state
+//
+
+import (
+	"net"
+	"net/netip"
+)
+
+// NetworkState is an opaque checkpoint of the conns bound to a [Network] and of
+// the datagrams queued for them, created by [Network.SaveState]. The zero value
+// is a valid checkpoint of a network without conns.
+type NetworkState struct {
+	// conns maps each bound address to its saved state.
+	conns map[netip.AddrPort]*networkSavedConnUDP
+}
+
+// networkSavedConnUDP is the saved state of a conn.
+type networkSavedConnUDP struct {
+	// acceptAnySource indicates whether a connected conn receives
+	// datagrams sent by any source rather than only by its peer.
+	acceptAnySource bool
+
+	// datagrams contains the datagrams that were waiting to be read.
+	datagrams []*networkWriteUDP
+
+	// id is the unique identifier of the conn.
+	id uint64
+
+	// peerAddr is the OPTIONAL address of the peer of a connected conn.
+	peerAddr netip.AddrPort
+}
+
+// networkSaveState is a request to save the network state.
+type networkSaveState struct {
+	// ack is closed by the Network layer to acknowledge that
+	// it has processed this message.
+	ack chan any
+
+	// state is the state set by the Network layer.
+	state NetworkState
+}
+
+// networkRestoreState is a request to restore the network state.
+type networkRestoreState struct {
+	// ack is closed by the Network layer to acknowledge that
+	// it has processed this message.
+	ack chan any
+
+	// err is the error set by the Network layer.
+	err error
+
+	// state is the state to restore.
+	state NetworkState
+}
+
+// SaveState atomically saves the set of bound conns and the datagrams waiting to be
+// read, such that a test can later roll back to this checkpoint using RestoreState.
+// The returned state is empty if the network has been closed.
+func (n *Network) SaveState() NetworkState {
+	req := &networkSaveState{
+		ack:   make(chan any),
+		state: NetworkState{},
+	}
+	select {
+	case <-n.closed:
+		return NetworkState{}
+
+	case n.saveState <- req:
+		select {
+		case <-n.closed:
+			return NetworkState{}
+
+		case <-req.ack:
+			return req.state
+		}
+	}
+}
+
+// RestoreState atomically rolls back the bound conns and their queued datagrams to
+// a checkpoint created using SaveState, but not the goroutines blocked in Read or
+// Write. A conn closed after the checkpoint stays closed, but [NewUDPConn] can take
+// over its restored address and datagrams. Conversely, we tear down the conns created
+// after the checkpoint, even when bound to the address of a conn closed since then:
+// their pending reads fail with [net.ErrClosed] and subsequent reads with
+// [syscall.EBADF], so you should close them. This method fails
+// with [net.ErrClosed] if the network is closed or draining.
+func (n *Network) RestoreState(state NetworkState) error {
+	req := &networkRestoreState{
+		ack:   make(chan any),
+		err:   nil,
+		state: state,
+	}
+	select {
+	case <-n.closed:
+		return net.ErrClosed
+
+	case n.restoreState <- req:
+		select {
+		case <-n.closed:
+			return net.ErrClosed
+
+		case <-req.ack:
+			return req.err
+		}
+	}
+}
+
+// takeOverOrphanUDP moves the datagrams queued for an orphan conn created by
+// RestoreState to the given conn, delivering them to its blocked reads, if any.
+func (n *Network) takeOverOrphanUDP(state, orphan *networkConnStateUDP) {
+	wasEmpty := len(state.blockedWrites) <= 0
+	for _, write := range orphan.blockedWrites {
+		state.pushWrite(write)
+	}
+	orphan.clearWrites()
+	state.updateHighWaterMarks()
+	for len(state.blockedReads) > 0 && len(state.blockedWrites) > 0 {
+		read := state.blockedReads[0]
+		state.blockedReads = state.blockedReads[1:]
+		n.finishReadWrite(read, n.popWriteUDP(state))
+	}
+	if wasEmpty && len(state.blockedWrites) > 0 {
+		state.notifyReadReady()
+	}
+}
+
+// onSaveState handles a request to save the network state.
+func (n *Network) onSaveState(req *networkSaveState) {
+	// always acknowledge the caller
+	defer close(req.ack)
+
+	// copy each conn and its queued datagrams, including the payloads, which
+	// belong to writers that may reuse them after we deliver or drop them
+	req.state.conns = map[netip.AddrPort]*networkSavedConnUDP{}
+	for addr, state := range n.udp {
+		saved := &networkSavedConnUDP{
+			acceptAnySource: state.acceptAnySource,
+			datagrams:       []*networkWriteUDP{},
+			id:              state.id,
+			peerAddr:        state.peerAddr,
+		}
+		for _, write := range state.blockedWrites {
+			saved.datagrams = append(saved.datagrams, &networkWriteUDP{
+				boundAddr:  write.boundAddr,
+				destAddr:   write.destAddr,
+				flowID:     write.flowID,
+				payload:    append([]byte{}, write.payload...),
+				seq:        write.seq,
+				sourceAddr: write.sourceAddr,
+				tos:        write.tos,
+			})
+		}
+		req.state.conns[addr] = saved
+	}
+}
+
+// onRestoreState handles a request to restore the network state.
+func (n *Network) onRestoreState(req *networkRestoreState) {
+	// always acknowledge the caller
+	defer close(req.ack)
+
+	// refuse to resurrect conns when gracefully closing
+	if n.isDraining() {
+		req.err = net.ErrClosed
+		return
+	}
+
+	// forget the conns that did not exist at the checkpoint, including the
+	// conns bound to the address of a conn closed after the checkpoint
+	for addr, state := range n.udp {
+		if saved := req.state.conns[addr]; saved == nil || saved.id != state.id {
+			n.teardownConnUDP(state)
+			delete(n.udp, addr)
+		}
+	}
+
+	for addr, saved := range req.state.conns {
+		// reuse the existing conn, if any, to keep its blocked reads, but drop
+		// the datagrams queued after the checkpoint; otherwise, create an orphan
+		// conn that a subsequent bind will take over
+		state := n.udp[addr]
+		if state != nil {
+			for _, write := range state.blockedWrites {
+				n.dropWrite(write, DropReasonConnClosed)
+			}
+			state.clearWrites()
+			state.acceptAnySource = saved.acceptAnySource
+			state.pendingErr = nil
+		} else {
+			n.nextConnID++
+			state = &networkConnStateUDP{
+				acceptAnySource:    saved.acceptAnySource,
+				blockedReads:       []*networkReadUDP{},
+				blockedWrites:      []*networkWriteUDP{},
+				highWaterBytes:     0,
+				highWaterDatagrams: 0,
+				id:                 n.nextConnID,
+				orphan:             true,
+				peerAddr:           saved.peerAddr,
+				pendingErr:         nil,
+				queueCredits:       map[int]int{},
+				queuedWrites:       0,
+				readReady:          nil,
+				writeQueues:        map[byte][]*networkWriteUDP{},
+			}
+			n.udp[addr] = state
+		}
+
+		// queue copies of the saved datagrams, such that we can restore
+		// the same checkpoint more than once
+		for _, datagram := range saved.datagrams {
+			write := &networkWriteUDP{
+				ack:        make(chan any),
+				blockedOn:  nil,
+				boundAddr:  datagram.boundAddr,
+				destAddr:   datagram.destAddr,
+				flowID:     datagram.flowID,
+				payload:    datagram.payload,
+				seq:        datagram.seq,
+				sourceAddr: datagram.sourceAddr,
+				tos:        datagram.tos,
+			}
+			state.pushWrite(write)
+		}
+		state.updateHighWaterMarks()
+
+		// deliver the restored datagrams to the reads that are already blocked
+		for len(state.blockedReads) > 0 && len(state.blockedWrites) > 0 {
+			read := state.blockedReads[0]
+			state.blockedReads = state.blockedReads[1:]
+			n.finishReadWrite(read, n.popWriteUDP(state))
+		}
+		if len(state.blockedWrites) > 0 {
+			state.notifyReadReady()
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package netemlite
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+)
+
+// boundAddrs returns the addresses of the conns bound to the network.
+func boundAddrs(n *Network) (addrs []string) {
+	for _, conn := range n.Dump().Conns {
+		addrs = append(addrs, conn.LocalAddr.String())
+	}
+	return
+}
+
+func TestRestoreStateRollsBackConns(t *testing.T) {
+	n := newTestNetwork(t)
+	newTestConn(t, n, "10.0.0.1:1234", "")
+	second := newTestConn(t, n, "10.0.0.2:53", "")
+	state := n.SaveState()
+
+	// change the set of conns after the checkpoint
+	second.Close()
+	third := newTestConn(t, n, "10.0.0.3:53", "")
+	if err := n.RestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	if addrs := boundAddrs(n); len(addrs) != 2 || addrs[0] != "10.0.0.1:1234" || addrs[1] != "10.0.0.2:53" {
+		t.Fatalf("unexpected conns %v", addrs)
+	}
+
+	// the conn bound after the checkpoint has been forgotten
+	if _, _, err := third.ReadFrom(make([]byte, 64)); !errors.Is(err, syscall.EBADF) {
+		t.Fatalf("expected EBADF, got %v", err)
+	}
+}
+
+func TestRestoreStateOrphanConn(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "checkpointed")
+	state := n.SaveState()
+
+	// closing the receiver drops the queued datagram
+	receiver.Close()
+	if err := n.RestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+
+	// the address is still bound, so a new conn takes over the datagram
+	waitBlockedWrites(t, n, "10.0.0.2:53", 1)
+	replacement := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	mustRead(t, replacement, "checkpointed")
+
+	// but the new conn cannot take over a conn that is not an orphan
+	if _, err := NewUDPConn(n, netip.MustParseAddrPort("10.0.0.2:53"), netip.AddrPort{}); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestRestoreStateReplacesConnWithDifferentIdentity(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	old := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "checkpointed")
+	state := n.SaveState()
+
+	// a new conn with another peer takes the address after the checkpoint
+	old.Close()
+	current := newTestConn(t, n, "10.0.0.2:53", "10.0.0.3:1234")
+	readch := make(chan error, 1)
+	go func() {
+		_, err := current.Read(make([]byte, 64))
+		readch <- err
+	}()
+	waitBlockedReads(t, n, "10.0.0.2:53", 1)
+
+	// restoring tears down the new conn rather than reusing its state
+	if err := n.RestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-readch; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if _, err := current.Read(make([]byte, 64)); !errors.Is(err, syscall.EBADF) {
+		t.Fatalf("expected EBADF, got %v", err)
+	}
+
+	// the address holds an orphan with the checkpointed peer and datagram
+	current.Close()
+	replacement := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	mustRead(t, replacement, "checkpointed")
+}
+
+func TestRestoreStateDropsNewerDatagrams(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "older")
+	state := n.SaveState()
+
+	// the writer of the datagram queued after the checkpoint returns
+	errch := writeAsync(sender, "newer")
+	waitBlockedWrites(t, n, "10.0.0.2:53", 2)
+	if err := n.RestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+	mustRead(t, receiver, "older")
+	waitBlockedWrites(t, n, "10.0.0.2:53", 0)
+}
+
+func TestRestoreStateMoreThanOnce(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "hello")
+	state := n.SaveState()
+	for idx := 0; idx < 3; idx++ {
+		mustRead(t, receiver, "hello")
+		if err := n.RestoreState(state); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRestoreStateServesBlockedReads(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "hello")
+	state := n.SaveState()
+	mustRead(t, receiver, "hello")
+
+	// a read blocked when we restore receives the restored datagram
+	readch := make(chan string, 1)
+	go func() {
+		buffer := make([]byte, 64)
+		count, _ := receiver.Read(buffer)
+		readch <- string(buffer[:count])
+	}()
+	waitBlockedReads(t, n, "10.0.0.2:53", 1)
+	if err := n.RestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-readch; got != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", got)
+	}
+}
+
+func TestRestoreStateClosedNetwork(t *testing.T) {
+	n := NewNetwork()
+	state := n.SaveState()
+	n.Close()
+	if err := n.RestoreState(state); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
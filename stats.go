@@ -0,0 +1,55 @@
+package netemlite
+
+//
+// Network statistics
+//
+
+// NetworkStats contains statistics about a [Network].
+type NetworkStats struct {
+	// Drops contains the number of dropped datagrams by reason.
+	Drops map[DropReason]uint64
+}
+
+// networkStats is a request to obtain statistics.
+type networkStats struct {
+	// ack is closed by the Network layer to acknowledge that
+	// it has processed this message.
+	ack chan any
+
+	// stats contains the statistics set by the Network layer.
+	stats NetworkStats
+}
+
+// Stats returns a copy of the network statistics, gathered by the background
+// goroutine. The returned statistics are empty if the network has been closed.
+func (n *Network) Stats() NetworkStats {
+	req := &networkStats{
+		ack:   make(chan any),
+		stats: NetworkStats{},
+	}
+	select {
+	case <-n.closed:
+		return NetworkStats{}
+
+	case n.stats <- req:
+		select {
+		case <-n.closed:
+			return NetworkStats{}
+
+		case <-req.ack:
+			return req.stats
+		}
+	}
+}
+
+// onStats handles a request to obtain statistics.
+func (n *Network) onStats(req *networkStats) {
+	// always acknowledge the caller
+	defer close(req.ack)
+
+	// copy the drops to avoid sharing the map with the caller
+	req.stats.Drops = make(map[DropReason]uint64, len(n.drops))
+	for reason, count := range n.drops {
+		req.stats.Drops[reason] = count
+	}
+}
@@ -0,0 +1,281 @@
+package netemlite
+
+//
+// Reliable messages over UDP
+//
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DatagramStream sends and receives messages reliably over a connected [UDPConn]
+// using a simple stop-and-wait protocol: each message travels inside a length
+// prefixed frame that the peer acknowledges, and the sender retransmits the frame
+// when it does not receive the acknowledgement in time. Both peers must use a
+// DatagramStream. The zero value is invalid; use [NewDatagramStream].
+type DatagramStream struct {
+	// acks receives the sequence numbers of the acknowledged frames.
+	acks chan uint32
+
+	// conn is the READONLY underlying conn.
+	conn *UDPConn
+
+	// done is closed when the background reader exits.
+	done chan any
+
+	// messages receives the messages read by the background reader.
+	messages chan []byte
+
+	// readErr is the error that caused the background reader to exit.
+	readErr error
+
+	// rto is the READONLY retransmission timeout.
+	rto time.Duration
+
+	// sendAcks receives the sequence numbers of the frames to acknowledge.
+	sendAcks chan uint32
+
+	// sendMu serializes calls to SendMessage.
+	sendMu sync.Mutex
+
+	// sendSeq is the sequence number of the next frame to send.
+	sendSeq uint32
+}
+
+const (
+	// datagramStreamData is the kind of frames containing a message.
+	datagramStreamData = byte(iota + 1)
+
+	// datagramStreamAck is the kind of frames acknowledging a message.
+	datagramStreamAck
+)
+
+const (
+	// datagramStreamHeaderSize is the size of the frame header, which contains
+	// the frame kind, the sequence number, and the payload length.
+	datagramStreamHeaderSize = 1 + 4 + 2
+
+	// datagramStreamMaxAttempts is the maximum number of times we send a frame.
+	datagramStreamMaxAttempts = 10
+
+	// datagramStreamQueueSize is the number of messages we buffer for RecvMessage.
+	datagramStreamQueueSize = 64
+)
+
+// NewDatagramStream creates a [DatagramStream] using the given connected conn
+// and retransmission timeout. The stream owns the conn, which you should not
+// use directly anymore. Use the Close method to close the stream and the conn.
+func NewDatagramStream(conn *UDPConn, rto time.Duration) *DatagramStream {
+	s := &DatagramStream{
+		acks:     make(chan uint32, datagramStreamQueueSize),
+		conn:     conn,
+		done:     make(chan any),
+		messages: make(chan []byte, datagramStreamQueueSize),
+		readErr:  nil,
+		rto:      rto,
+		sendAcks: make(chan uint32, datagramStreamQueueSize),
+		sendMu:   sync.Mutex{},
+		sendSeq:  0,
+	}
+	go s.readLoop()
+	go s.ackLoop()
+	return s
+}
+
+// SendMessage sends a message and waits for the peer to acknowledge it, possibly
+// retransmitting the message several times. This method fails with [syscall.ETIMEDOUT]
+// if the peer does not acknowledge the message after several retransmissions and
+// with [syscall.EMSGSIZE] if the message is too large to fit into a frame.
+func (s *DatagramStream) SendMessage(message []byte) error {
+	// make sure the frame fits into a datagram
+	if len(message) > s.maxMessageSize() {
+		return syscall.EMSGSIZE
+	}
+
+	// one message at a time
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	seq := s.sendSeq
+	frame := encodeDatagramStreamFrame(datagramStreamData, seq, message)
+
+	for attempt := 0; attempt < datagramStreamMaxAttempts; attempt++ {
+		// (re)transmit the frame, giving up on the write when the RTO expires
+		// because the peer may be too busy to read it, without using the write
+		// deadline, which would also affect the acknowledgements
+		if _, err := s.conn.writeWithTimeout(frame, s.rto); isFatalDatagramStreamError(err) {
+			return err
+		}
+
+		// wait for the acknowledgement or for the RTO to expire
+		if s.waitAck(seq) {
+			s.sendSeq++
+			return nil
+		}
+
+		// stop if the background reader is done
+		select {
+		case <-s.done:
+			return s.readErr
+		default:
+		}
+	}
+	return syscall.ETIMEDOUT
+}
+
+// maxMessageSize returns the size of the largest message that fits into a frame,
+// which is smaller than the largest length the frame header can represent.
+func (s *DatagramStream) maxMessageSize() int {
+	return maxPayloadSize(s.conn.peerAddr) - datagramStreamHeaderSize
+}
+
+// waitAck waits for the acknowledgement of the given frame until the RTO expires.
+func (s *DatagramStream) waitAck(seq uint32) bool {
+	timer := time.NewTimer(s.rto)
+	defer timer.Stop()
+	for {
+		select {
+		case ack := <-s.acks:
+			if ack == seq {
+				return true
+			}
+			// ignore acknowledgements of previously retransmitted frames
+
+		case <-timer.C:
+			return false
+
+		case <-s.done:
+			return false
+		}
+	}
+}
+
+// RecvMessage returns the next message sent by the peer.
+func (s *DatagramStream) RecvMessage() ([]byte, error) {
+	select {
+	case message := <-s.messages:
+		return message, nil
+
+	case <-s.done:
+		// drain messages received before the reader exited
+		select {
+		case message := <-s.messages:
+			return message, nil
+		default:
+			return nil, s.readErr
+		}
+	}
+}
+
+// Close closes the stream and the underlying conn.
+func (s *DatagramStream) Close() error {
+	return s.conn.Close()
+}
+
+// readLoop reads frames until the conn is closed.
+func (s *DatagramStream) readLoop() {
+	defer close(s.done)
+	var recvSeq uint32
+	buffer := make([]byte, maxPayloadSize(s.conn.peerAddr))
+	for {
+		// read the next frame
+		count, err := s.conn.Read(buffer)
+		if err != nil {
+			s.readErr = err
+			return
+		}
+		kind, seq, payload, ok := decodeDatagramStreamFrame(buffer[:count])
+		if !ok {
+			continue
+		}
+
+		switch kind {
+		case datagramStreamAck:
+			// pass the acknowledgement to the sender, if it has room
+			select {
+			case s.acks <- seq:
+			default:
+			}
+
+		case datagramStreamData:
+			// queue the next expected message, unless we have no room for
+			// it, in which case we do not acknowledge it, so the peer will
+			// retransmit it later
+			if seq == recvSeq {
+				select {
+				case s.messages <- append([]byte{}, payload...):
+					recvSeq++
+				default:
+					continue
+				}
+			}
+
+			// acknowledge new and retransmitted messages using the ack writer
+			// because writes block until the peer reads; if the ack writer has
+			// no room, the peer will retransmit and we will try again
+			if seq < recvSeq {
+				select {
+				case s.sendAcks <- seq:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// ackLoop writes the acknowledgements until the background reader exits. We
+// give up on an acknowledgement that the peer does not read within the RTO, since
+// the peer will retransmit the frame, and we stop on errors such as a closed conn,
+// which also cause the background reader to exit.
+func (s *DatagramStream) ackLoop() {
+	for {
+		select {
+		case <-s.done:
+			return
+
+		case seq := <-s.sendAcks:
+			frame := encodeDatagramStreamFrame(datagramStreamAck, seq, nil)
+			if _, err := s.conn.writeWithTimeout(frame, s.rto); isFatalDatagramStreamError(err) {
+				return
+			}
+		}
+	}
+}
+
+// isFatalDatagramStreamError returns whether an error prevents retransmitting.
+func isFatalDatagramStreamError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return false
+	}
+	return true
+}
+
+// encodeDatagramStreamFrame encodes a frame.
+func encodeDatagramStreamFrame(kind byte, seq uint32, payload []byte) []byte {
+	frame := make([]byte, 0, datagramStreamHeaderSize+len(payload))
+	frame = append(frame, kind)
+	frame = binary.BigEndian.AppendUint32(frame, seq)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	return append(frame, payload...)
+}
+
+// decodeDatagramStreamFrame decodes a frame.
+func decodeDatagramStreamFrame(frame []byte) (kind byte, seq uint32, payload []byte, ok bool) {
+	if len(frame) < datagramStreamHeaderSize {
+		return 0, 0, nil, false
+	}
+	kind = frame[0]
+	seq = binary.BigEndian.Uint32(frame[1:5])
+	length := int(binary.BigEndian.Uint16(frame[5:7]))
+	payload = frame[datagramStreamHeaderSize:]
+	if len(payload) != length {
+		return 0, 0, nil, false
+	}
+	return kind, seq, payload, true
+}
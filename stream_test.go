@@ -0,0 +1,134 @@
+package netemlite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// useLossyLink installs a middleware dropping the given fraction of the writes.
+func useLossyLink(n *Network, loss float64) {
+	// the middleware runs in the background goroutine, so using the
+	// random number generator does not require synchronization
+	rng := rand.New(rand.NewSource(1))
+	n.Use(func(next RequestHandler) RequestHandler {
+		return RequestHandlerFunc(func(req Request) {
+			if req.Kind() == RequestWriteUDP && rng.Float64() < loss {
+				req.Complete(nil)
+				return
+			}
+			next.Handle(req)
+		})
+	})
+}
+
+// sendMessages sends count messages with the given prefix in the background
+// and returns a channel receiving the first error or nil.
+func sendMessages(stream *DatagramStream, prefix string, count int) <-chan error {
+	errch := make(chan error, 1)
+	go func() {
+		for idx := 0; idx < count; idx++ {
+			if err := stream.SendMessage([]byte(fmt.Sprint(prefix, idx))); err != nil {
+				errch <- err
+				return
+			}
+		}
+		errch <- nil
+	}()
+	return errch
+}
+
+// newTestDatagramStreams creates two connected streams closed when the test ends.
+func newTestDatagramStreams(t *testing.T, n *Network, rto time.Duration) (*DatagramStream, *DatagramStream) {
+	t.Helper()
+	left := NewDatagramStream(newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:443"), rto)
+	t.Cleanup(func() { left.Close() })
+	right := NewDatagramStream(newTestConn(t, n, "10.0.0.2:443", "10.0.0.1:1234"), rto)
+	t.Cleanup(func() { right.Close() })
+	return left, right
+}
+
+func TestDatagramStreamLossyLink(t *testing.T) {
+	n := newTestNetwork(t)
+	useLossyLink(n, 0.2)
+	sender, receiver := newTestDatagramStreams(t, n, 20*time.Millisecond)
+
+	const count = 20
+	errch := sendMessages(sender, "message ", count)
+	for idx := 0; idx < count; idx++ {
+		message, err := receiver.RecvMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expect := fmt.Sprint("message ", idx); string(message) != expect {
+			t.Fatalf("expected %q, got %q", expect, message)
+		}
+	}
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+	if drops := n.Stats().Drops[DropReasonMiddleware]; drops <= 0 {
+		t.Fatal("expected the link to drop some frames")
+	}
+}
+
+func TestDatagramStreamBidirectionalLossyLink(t *testing.T) {
+	n := newTestNetwork(t)
+	useLossyLink(n, 0.2)
+	left, right := newTestDatagramStreams(t, n, 20*time.Millisecond)
+
+	// both peers send and acknowledge at the same time, so the acknowledgements
+	// must not be affected by the timeouts of the retransmitted frames
+	const count = 20
+	leftErr := sendMessages(left, "left", count)
+	rightErr := sendMessages(right, "right", count)
+
+	for idx := 0; idx < count; idx++ {
+		for _, pair := range []struct {
+			stream *DatagramStream
+			expect string
+		}{{right, fmt.Sprint("left", idx)}, {left, fmt.Sprint("right", idx)}} {
+			message, err := pair.stream.RecvMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(message) != pair.expect {
+				t.Fatalf("expected %q, got %q", pair.expect, message)
+			}
+		}
+	}
+	if err := <-leftErr; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-rightErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDatagramStreamMessageSize(t *testing.T) {
+	n := newTestNetwork(t)
+	sender, receiver := newTestDatagramStreams(t, n, time.Second)
+
+	// the largest message fills the largest IPv4 datagram
+	const largest = 65507 - datagramStreamHeaderSize
+	errch := make(chan error, 1)
+	go func() {
+		errch <- sender.SendMessage(bytes.Repeat([]byte{'a'}, largest))
+	}()
+	message, err := receiver.RecvMessage()
+	if err != nil || len(message) != largest {
+		t.Fatalf("expected %d bytes, got %d and %v", largest, len(message), err)
+	}
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+
+	// a larger message fails immediately
+	if err := sender.SendMessage(make([]byte, largest+1)); !errors.Is(err, syscall.EMSGSIZE) {
+		t.Fatalf("expected EMSGSIZE, got %v", err)
+	}
+}
@@ -5,10 +5,13 @@ package netemlite
 //
 
 import (
+	"context"
+	"io"
 	"net"
 	"net/netip"
 	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -16,26 +19,94 @@ import (
 // UDPConn is an UDP connection. The zero value of this struct
 // is invalid; please, use [NewUDPConn] to construct.
 type UDPConn struct {
+	// bytesRead is the number of bytes read.
+	bytesRead atomic.Uint64
+
+	// bytesWritten is the number of bytes written.
+	bytesWritten atomic.Uint64
+
 	// closed is closed by Closed.
 	closed chan any
 
-	// localAddr is the READONLY local address.
+	// datagramsRead is the number of datagrams read.
+	datagramsRead atomic.Uint64
+
+	// datagramsWritten is the number of datagrams written.
+	datagramsWritten atomic.Uint64
+
+	// dontFragment indicates whether the Don't Fragment bit is set.
+	dontFragment atomic.Bool
+
+	// ecn indicates whether we send ECN-capable datagrams.
+	ecn atomic.Bool
+
+	// flows maps the ID of each conn that sent us datagrams to the
+	// source address of its last datagram.
+	flows map[uint64]netip.AddrPort
+
+	// gro indicates whether ReadMsgUDPGRO coalesces datagrams.
+	gro atomic.Bool
+
+	// gsoSize is the segment size set by SetGSO.
+	gsoSize atomic.Int64
+
+	// localAddr is the local address, which may change using Rebind.
 	localAddr netip.AddrPort
 
+	// mu protects flows, localAddr, peerChangeObserver, readBlockObserver,
+	// and writeErrorObserver.
+	mu sync.Mutex
+
 	// network is the READONLY network to use.
 	network *Network
 
+	// nonblock indicates whether reads fail instead of blocking.
+	nonblock atomic.Bool
+
 	// once ensures Close runs just once.
 	once sync.Once
 
 	// peerAddr is the READONLY, OPTIONAL peer address.
 	peerAddr netip.AddrPort
 
+	// peerChangeObserver is the OPTIONAL observer for source address changes.
+	peerChangeObserver func(old, new netip.AddrPort)
+
+	// readBlockObserver is the OPTIONAL observer told whether reads block.
+	readBlockObserver func(blocked bool)
+
 	// readDeadline contains the read deadline.
 	readDeadline *pipeDeadline
 
+	// readPacketInfo indicates whether ReadMsgUDP returns packet info.
+	readPacketInfo atomic.Bool
+
+	// readReady is the READONLY channel returned by ReadReady.
+	readReady chan struct{}
+
+	// readTimeout is the default read timeout, which is zero when disabled.
+	readTimeout atomic.Int64
+
+	// receiveHopLimit indicates whether ReadMsgUDP returns hop limits.
+	receiveHopLimit atomic.Bool
+
+	// receiveTOS indicates whether ReadMsgUDP returns the ToS byte.
+	receiveTOS atomic.Bool
+
+	// receiveTimestamp indicates whether ReadMsgUDP returns timestamps.
+	receiveTimestamp atomic.Bool
+
+	// tos is the ToS byte set by SetTOS.
+	tos atomic.Uint32
+
 	// writeDeadline contains the write deadline.
 	writeDeadline *pipeDeadline
+
+	// writeErrorObserver is the OPTIONAL observer for dropped datagrams.
+	writeErrorObserver func(payloadLen int, dst netip.AddrPort, reason DropReason)
+
+	// writeTimeout is the default write timeout, which is zero when disabled.
+	writeTimeout atomic.Int64
 }
 
 // A UDPConn is also a valid net.PacketConn.
@@ -50,7 +121,8 @@ var _ net.Conn = &UDPConn{}
 //
 // - network is the [Network] to use;
 //
-// - localAddr is the local address of the connection;
+// - localAddr is the local address of the connection, where a zero port means
+// that the [AddressAllocator] of the network chooses the port;
 //
 // - peerAddr is the OPTIONAL peer address.
 //
@@ -58,20 +130,52 @@ var _ net.Conn = &UDPConn{}
 func NewUDPConn(network *Network, localAddr, peerAddr netip.AddrPort) (*UDPConn, error) {
 	// initialize the connection
 	c := &UDPConn{
-		closed:        make(chan any),
-		localAddr:     localAddr,
-		network:       network,
-		once:          sync.Once{},
-		peerAddr:      peerAddr,
-		readDeadline:  makePipeDeadline(),
-		writeDeadline: makePipeDeadline(),
+		bytesRead:          atomic.Uint64{},
+		bytesWritten:       atomic.Uint64{},
+		closed:             make(chan any),
+		datagramsRead:      atomic.Uint64{},
+		datagramsWritten:   atomic.Uint64{},
+		dontFragment:       atomic.Bool{},
+		ecn:                atomic.Bool{},
+		flows:              map[uint64]netip.AddrPort{},
+		gro:                atomic.Bool{},
+		gsoSize:            atomic.Int64{},
+		localAddr:          localAddr,
+		mu:                 sync.Mutex{},
+		network:            network,
+		nonblock:           atomic.Bool{},
+		once:               sync.Once{},
+		peerAddr:           peerAddr,
+		peerChangeObserver: nil,
+		readBlockObserver:  nil,
+		readDeadline:       makePipeDeadline(),
+		readPacketInfo:     atomic.Bool{},
+		readReady:          make(chan struct{}, 1),
+		readTimeout:        atomic.Int64{},
+		receiveHopLimit:    atomic.Bool{},
+		receiveTOS:         atomic.Bool{},
+		receiveTimestamp:   atomic.Bool{},
+		tos:                atomic.Uint32{},
+		writeDeadline:      makePipeDeadline(),
+		writeErrorObserver: nil,
+		writeTimeout:       atomic.Int64{},
 	}
+	readTimeout, writeTimeout := network.getDefaultDeadlines()
+	c.readTimeout.Store(int64(readTimeout))
+	c.writeTimeout.Store(int64(writeTimeout))
 
 	// initialize the request to register the connection
 	req := &networkNewConnUDP{
 		ack:       make(chan any),
 		err:       nil,
 		localAddr: localAddr,
+		peerAddr:  peerAddr,
+		readReady: c.readReady,
+	}
+
+	// simulate a slow bind, if needed
+	if err := network.waitBindDelay(); err != nil {
+		return nil, err
 	}
 
 	// attempt to register the connection
@@ -85,14 +189,73 @@ func NewUDPConn(network *Network, localAddr, peerAddr netip.AddrPort) (*UDPConn,
 			return nil, net.ErrClosed
 
 		case <-req.ack:
-			return c, req.err
+			if req.err != nil {
+				return c, req.err
+			}
+			c.localAddr = req.localAddr
+			return c, nil
 		}
 	}
 }
 
 // LocalAddr returns the local addr.
 func (c *UDPConn) LocalAddr() net.Addr {
-	return net.UDPAddrFromAddrPort(c.localAddr)
+	return net.UDPAddrFromAddrPort(c.getLocalAddr())
+}
+
+// getLocalAddr returns the current local address.
+func (c *UDPConn) getLocalAddr() netip.AddrPort {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.localAddr
+}
+
+// Rebind atomically moves the conn to a new local address, which models connection
+// migration. This method fails with [syscall.EADDRINUSE] if another conn is already
+// bound to the new address. The datagrams queued for the old address follow the
+// conn and are delivered to it at the new address, along with the datagrams of a
+// conn restored at the new address by [Network.RestoreState], if any. Like binding,
+// using port zero allocates an ephemeral port (see [AddressAllocator]). This method
+// fails with [net.ErrClosed] if the network is draining.
+func (c *UDPConn) Rebind(newAddr netip.AddrPort) error {
+	// make sure the new address is valid
+	if !newAddr.IsValid() {
+		return syscall.EINVAL
+	}
+
+	// prevent concurrent rebinds and reads of the local address
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// create the request for rebinding
+	req := &networkRebindUDP{
+		ack:     make(chan any),
+		err:     nil,
+		newAddr: newAddr,
+		oldAddr: c.localAddr,
+	}
+
+	// attempt to rebind the conn
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+
+	case <-c.network.closed:
+		return net.ErrClosed
+
+	case c.network.rebindUDP <- req:
+		select {
+		case <-c.network.closed:
+			return net.ErrClosed
+
+		case <-req.ack:
+			if req.err != nil {
+				return req.err
+			}
+			c.localAddr = req.newAddr
+			return nil
+		}
+	}
 }
 
 // RemoteAddr returns the POSSIBLY NIL remote addr.
@@ -103,30 +266,116 @@ func (c *UDPConn) RemoteAddr() net.Addr {
 	return net.UDPAddrFromAddrPort(c.peerAddr)
 }
 
-// SetReadDeadline sets the read deadline.
+// SetReadDeadline sets the read deadline and disables the default read
+// timeout configured using [Network.SetDefaultDeadlines].
 func (c *UDPConn) SetReadDeadline(t time.Time) error {
 	select {
 	case <-c.closed:
 		return net.ErrClosed
 
 	default:
+		c.readTimeout.Store(0)
 		c.readDeadline.set(t)
 		return nil
 	}
 }
 
-// SetWriteDeadline sets the read deadline.
+// SetWriteDeadline sets the write deadline and disables the default write
+// timeout configured using [Network.SetDefaultDeadlines].
 func (c *UDPConn) SetWriteDeadline(t time.Time) error {
 	select {
 	case <-c.closed:
 		return net.ErrClosed
 
 	default:
+		c.writeTimeout.Store(0)
 		c.writeDeadline.set(t)
 		return nil
 	}
 }
 
+// IOStats returns the number of bytes and datagrams successfully read and
+// written using this conn. Because the counters are updated atomically, this
+// method is cheap and does not need to interact with the [Network].
+func (c *UDPConn) IOStats() (bytesRead, bytesWritten, datagramsRead, datagramsWritten uint64) {
+	return c.bytesRead.Load(), c.bytesWritten.Load(), c.datagramsRead.Load(), c.datagramsWritten.Load()
+}
+
+// SetLinger always fails with [syscall.ENOPROTOOPT] because, like the
+// kernel, we do not support SO_LINGER for UDP sockets.
+func (c *UDPConn) SetLinger(sec int) error {
+	return syscall.ENOPROTOOPT
+}
+
+// SetDontFragment controls whether to set the Don't Fragment bit (like setting
+// IP_MTU_DISCOVER to IP_PMTUDISC_DO). When set, writing a datagram that does not
+// fit into the MTU configured using [Network.SetMTU] fails immediately with
+// [syscall.EMSGSIZE] rather than being sent.
+func (c *UDPConn) SetDontFragment(enabled bool) {
+	c.dontFragment.Store(enabled)
+}
+
+// MTU returns the MTU of the path towards the peer (like getting IP_MTU), which
+// is the value configured using [Network.SetMTU] or, when the MTU is unlimited,
+// the size of the largest packet we can send. Like the kernel, this method fails
+// with [syscall.ENOTCONN] if the conn is not connected.
+func (c *UDPConn) MTU() (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+
+	default:
+		if !c.peerAddr.IsValid() {
+			return 0, syscall.ENOTCONN
+		}
+		if mtu := c.network.getMTU(); mtu > 0 {
+			return mtu, nil
+		}
+		return packetSize(maxPayloadSize(c.peerAddr), c.peerAddr), nil
+	}
+}
+
+// SetTOS sets the ToS byte (like setting IP_TOS or IPV6_TCLASS) of the datagrams
+// subsequently sent by this conn, whose DSCP value selects the priority queue used
+// by the destination (see [Network.SetPriorityQueues]).
+func (c *UDPConn) SetTOS(tos byte) {
+	c.tos.Store(uint32(tos))
+}
+
+// SetWriteErrorObserver sets the function called when the [Network] drops a
+// datagram sent by this conn. Because UDP writes succeed even when the datagram
+// is lost, this is the only way to know that a specific send was dropped. The
+// observer runs in the goroutine that called Write or WriteTo. A nil value
+// disables the observer.
+func (c *UDPConn) SetWriteErrorObserver(fn func(payloadLen int, dst netip.AddrPort, reason DropReason)) {
+	c.mu.Lock()
+	c.writeErrorObserver = fn
+	c.mu.Unlock()
+}
+
+// SetPeerChangeObserver sets the function called when the datagrams a conn sends to
+// this non-connected conn start arriving from another source address, which happens
+// when the sender migrates using [UDPConn.Rebind]. The observer runs in the reading
+// goroutine. A nil value disables the observer.
+func (c *UDPConn) SetPeerChangeObserver(fn func(old, new netip.AddrPort)) {
+	c.mu.Lock()
+	c.peerChangeObserver = fn
+	c.flows = map[uint64]netip.AddrPort{}
+	c.mu.Unlock()
+}
+
+// SetReadBlockObserver sets the function called by the [Network] for each read
+// to report whether a datagram was immediately available (false) or the read had
+// to block waiting for one (true). This is useful to check that a read loop does
+// not block unnecessarily. The observer runs in the background goroutine of the
+// network, so it MUST NOT block or call methods waiting for that goroutine, such
+// as Dump, which would hang the network. A nil value disables the observer.
+func (c *UDPConn) SetReadBlockObserver(fn func(blocked bool)) {
+	c.mu.Lock()
+	c.readBlockObserver = fn
+	c.mu.Unlock()
+}
+
 // SetDeadline sets the read and the write deadlines.
 func (c *UDPConn) SetDeadline(t time.Time) error {
 	if err := c.SetReadDeadline(t); err != nil {
@@ -142,10 +391,15 @@ func (c *UDPConn) Close() error {
 		req := &networkDeleteConnUDP{
 			ack:       make(chan any),
 			err:       nil,
-			localAddr: c.localAddr,
+			localAddr: c.getLocalAddr(),
 		}
 
 		// tell the network we're shutting down
+		//
+		// We MUST NOT depend on receiving the ack: the network may be closed
+		// after it has accepted the request but before it processes it, in
+		// which case the background worker exits without closing the ack.
+		// Hence, we also watch the closed channel at both stages.
 		select {
 		case <-c.network.closed:
 			// nothing
@@ -167,32 +421,54 @@ func (c *UDPConn) Close() error {
 }
 
 // Read reads from a connected UDP socket.
+//
+// Like the kernel, each read consumes a whole datagram. If the datagram is larger
+// than the buffer, we discard the excess bytes, so a nil or zero-length buffer
+// consumes the datagram and returns zero. Use ReadMsgUDP to know whether the
+// datagram was truncated.
 func (c *UDPConn) Read(buffer []byte) (int, error) {
 	// make sure we're connected
 	if !c.peerAddr.IsValid() {
 		return 0, syscall.ENOTCONN
 	}
 
-	for {
-		// read a datagram from the network
-		count, source, err := c.commonRead(buffer)
+	// read from the network, which only delivers datagrams sent by the peer
+	count, _, err := c.commonRead(buffer)
+	return count, err
+}
 
-		// stop in case of errors
-		if err != nil {
-			return 0, err
-		}
+// ReadWithTimeout is like Read but gives up when either the context is done, in which
+// case it returns the context error, or the given timeout expires, in which case it
+// returns [os.ErrDeadlineExceeded], whichever happens first. A zero or negative timeout
+// means no timeout. This method does not modify the read deadline, which still applies.
+func (c *UDPConn) ReadWithTimeout(ctx context.Context, buffer []byte, timeout time.Duration) (int, error) {
+	// make sure we're connected
+	if !c.peerAddr.IsValid() {
+		return 0, syscall.ENOTCONN
+	}
 
-		// make sure the datagram is from the peer
-		if source != c.peerAddr {
-			continue
-		}
+	// bound the read using a child context, such that we can tell whether
+	// the timeout expired or the parent context is done
+	readCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		readCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 
-		// successfull return to the caller
-		return count, nil
+	// read from the network, which only delivers datagrams sent by the peer
+	req := c.newReadRequest(buffer)
+	if err := c.issueReadContext(readCtx, req); err != nil {
+		if readCtx.Err() != nil && ctx.Err() == nil {
+			return 0, os.ErrDeadlineExceeded
+		}
+		return 0, err
 	}
+	return req.count, nil
 }
 
-// ReadFrom reads from a non-connected UDP socket.
+// ReadFrom reads from a non-connected UDP socket. See Read for how we handle
+// datagrams larger than the buffer.
 func (c *UDPConn) ReadFrom(buffer []byte) (int, net.Addr, error) {
 	// make sure we're not connected
 	if c.peerAddr.IsValid() {
@@ -211,48 +487,321 @@ func (c *UDPConn) ReadFrom(buffer []byte) (int, net.Addr, error) {
 	return count, net.UDPAddrFromAddrPort(source), nil
 }
 
+// ReadFromDst is like ReadFrom but also returns the destination address of the
+// datagram, which is useful to know which concrete address the datagram was sent
+// to when the conn is bound to the wildcard address.
+func (c *UDPConn) ReadFromDst(buffer []byte) (n int, src, dst netip.AddrPort, err error) {
+	// make sure we're not connected
+	if c.peerAddr.IsValid() {
+		return 0, netip.AddrPort{}, netip.AddrPort{}, syscall.EISCONN
+	}
+
+	// read from the network
+	req := c.newReadRequest(buffer)
+	if err := c.issueRead(req); err != nil {
+		return 0, netip.AddrPort{}, netip.AddrPort{}, err
+	}
+	return req.count, req.senderAddr, req.destAddr, nil
+}
+
+// ReadFromSeq is like ReadFrom but also returns the sequence number that the
+// [Network] assigned to the datagram, which allows correlating sends and
+// receives. The network numbers datagrams starting from one in the order in
+// which it accepts them, regardless of the sender.
+func (c *UDPConn) ReadFromSeq(buffer []byte) (n int, addr netip.AddrPort, seq uint64, err error) {
+	// make sure we're not connected
+	if c.peerAddr.IsValid() {
+		return 0, netip.AddrPort{}, 0, syscall.EISCONN
+	}
+
+	// read from the network
+	req := c.newReadRequest(buffer)
+	if err := c.issueRead(req); err != nil {
+		return 0, netip.AddrPort{}, 0, err
+	}
+	return req.count, req.senderAddr, req.seq, nil
+}
+
+// SetReadPacketInfo controls whether ReadMsgUDP populates the OOB buffer
+// with the destination address of each datagram (like IP_PKTINFO). Use
+// [ParsePacketInfoOOB] to extract the address from the OOB buffer.
+func (c *UDPConn) SetReadPacketInfo(enabled bool) {
+	c.readPacketInfo.Store(enabled)
+}
+
+// SetReceiveTimestamp controls whether ReadMsgUDP populates the OOB buffer
+// with the time when the [Network] delivered each datagram (like SO_TIMESTAMP).
+// Use [ParseTimestampOOB] to extract the time from the OOB buffer.
+func (c *UDPConn) SetReceiveTimestamp(enabled bool) {
+	c.receiveTimestamp.Store(enabled)
+}
+
+// SetReceiveHopLimit controls whether ReadMsgUDP populates the OOB buffer with
+// the TTL or hop limit of each datagram (like IP_RECVTTL or IPV6_RECVHOPLIMIT).
+// Because the [Network] delivers datagrams directly without simulating routers,
+// the hop limit is always the initial one, i.e., 64. Use [ParseHopLimitOOB] to
+// extract the hop limit from the OOB buffer.
+func (c *UDPConn) SetReceiveHopLimit(enabled bool) {
+	c.receiveHopLimit.Store(enabled)
+}
+
+// SetReceiveTOS controls whether ReadMsgUDP populates the OOB buffer with the
+// ToS byte of each datagram (like IP_RECVTOS or IPV6_RECVTCLASS), which contains
+// the ECN codepoint. Use [ParseECNOOB] to extract the ECN codepoint from the OOB
+// buffer.
+func (c *UDPConn) SetReceiveTOS(enabled bool) {
+	c.receiveTOS.Store(enabled)
+}
+
+// ReadMsgUDP reads a datagram into buffer and the enabled control messages into
+// oob. The flags may contain [MsgTrunc] if the datagram was larger than the buffer
+// and [MsgCtrunc] if the control messages did not fit into oob. On a connected
+// conn, the returned address is the peer address. A nil or zero-length buffer
+// consumes the datagram and returns zero along with [MsgTrunc], unless the
+// datagram itself was empty.
+func (c *UDPConn) ReadMsgUDP(buffer, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error) {
+	return c.readMsg(buffer, oob, false)
+}
+
+// readMsg is the common code for ReadMsgUDP and ReadMsgUDPGRO.
+func (c *UDPConn) readMsg(buffer, oob []byte, gro bool) (n, oobn, flags int, addr *net.UDPAddr, err error) {
+	// read from the network
+	req := c.newReadRequest(buffer)
+	req.gro = gro
+	if err := c.issueRead(req); err != nil {
+		return 0, 0, 0, nil, err
+	}
+
+	// fill the control messages
+	w := &oobWriter{buffer: oob, flags: 0, oobn: 0}
+	if c.readPacketInfo.Load() {
+		data, _ := req.destAddr.MarshalBinary()
+		w.append(oobPacketInfo, data)
+	}
+	if c.receiveTimestamp.Load() {
+		w.append(oobTimestamp, encodeTimestampOOB(req.timestamp))
+	}
+	if c.receiveHopLimit.Load() {
+		w.append(oobHopLimit, []byte{defaultHopLimit})
+	}
+	if c.receiveTOS.Load() {
+		w.append(oobTOS, []byte{req.tos})
+	}
+	if req.segments > 1 {
+		w.append(oobSegmentSize, encodeSegmentSizeOOB(req.size/req.segments))
+	}
+
+	// handle successful case
+	flags = w.flags
+	if req.count < req.size {
+		flags |= MsgTrunc
+	}
+	return req.count, w.oobn, flags, net.UDPAddrFromAddrPort(req.senderAddr), nil
+}
+
+// ReadBorrow reads the next datagram into a buffer owned by the [Network] rather
+// than into a caller-provided buffer. The returned payload is only valid until you
+// call release, which returns the buffer to the network's pool. You MUST NOT retain
+// or access the payload after calling release and you SHOULD always call release
+// to allow reusing the buffer.
+func (c *UDPConn) ReadBorrow() (payload []byte, addr netip.AddrPort, release func(), err error) {
+	// prepare a request asking the network to provide the buffer
+	req := c.newReadRequest(nil)
+	req.borrow = true
+
+	// read a datagram from the network
+	if err := c.issueRead(req); err != nil {
+		return nil, netip.AddrPort{}, nil, err
+	}
+	return req.buffer[:req.count], req.senderAddr, c.network.releaseFunc(req.buffer), nil
+}
+
+// WriteNextTo reads the next datagram and writes it into the given writer without
+// using an intermediate caller-provided buffer. This method honors the read deadline
+// and returns the number of bytes written into the writer.
+func (c *UDPConn) WriteNextTo(w io.Writer) (int64, error) {
+	payload, _, release, err := c.ReadBorrow()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	count, err := w.Write(payload)
+	return int64(count), err
+}
+
 // commonRead is the common code for reading
 func (c *UDPConn) commonRead(buffer []byte) (int, netip.AddrPort, error) {
-	// prepare request
-	req := &networkReadUDP{
-		ack:        make(chan any),
-		buffer:     buffer,
-		count:      0,
-		err:        nil,
-		localAddr:  c.localAddr,
-		senderAddr: netip.AddrPort{},
+	req := c.newReadRequest(buffer)
+	if err := c.issueRead(req); err != nil {
+		return 0, netip.AddrPort{}, err
+	}
+	return req.count, req.senderAddr, nil
+}
+
+// newReadRequest creates a new read request using the given buffer.
+func (c *UDPConn) newReadRequest(buffer []byte) *networkReadUDP {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &networkReadUDP{
+		ack:           make(chan any),
+		blockObserver: c.readBlockObserver,
+		blockedOn:     nil,
+		borrow:        false,
+		buffer:        buffer,
+		count:         0,
+		destAddr:      netip.AddrPort{},
+		err:           nil,
+		flowID:        0,
+		gro:           false,
+		localAddr:     c.localAddr,
+		nonblock:      c.nonblock.Load(),
+		segments:      0,
+		senderAddr:    netip.AddrPort{},
+		seq:           0,
+		size:          0,
+		spurious:      false,
+		timestamp:     time.Time{},
+		tos:           0,
+	}
+}
+
+// issueRead sends a read request to the network and waits for its completion.
+func (c *UDPConn) issueRead(req *networkReadUDP) error {
+	return c.issueReadContext(context.Background(), req)
+}
+
+// issueReadSkippingSpurious is like issueRead but reads again after a spurious
+// wakeup (see [Network.SetSpuriousWakeups]), which completes the read without a
+// datagram and would otherwise be indistinguishable from reading an empty datagram.
+func (c *UDPConn) issueReadSkippingSpurious(req *networkReadUDP) error {
+	for {
+		if err := c.issueRead(req); err != nil || !req.spurious {
+			return err
+		}
+		req.ack, req.spurious = make(chan any), false
+	}
+}
+
+// issueReadContext is like issueRead but also returns the context error
+// as soon as the given context is done.
+func (c *UDPConn) issueReadContext(ctx context.Context, req *networkReadUDP) error {
+	// fail if the conn is closed, because the select below chooses randomly
+	// among the ready cases and the network could serve the read
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	default:
+	}
+
+	// apply the default read timeout, if any
+	if timeout := time.Duration(c.readTimeout.Load()); timeout > 0 {
+		c.readDeadline.set(time.Now().Add(timeout))
 	}
 
 	// issue the request
 	select {
 	case <-c.closed:
-		return 0, netip.AddrPort{}, net.ErrClosed
+		return net.ErrClosed
 
 	case <-c.network.closed:
-		return 0, netip.AddrPort{}, net.ErrClosed
+		return net.ErrClosed
 
 	case <-c.readDeadline.wait():
-		return 0, netip.AddrPort{}, os.ErrDeadlineExceeded
+		return os.ErrDeadlineExceeded
+
+	case <-ctx.Done():
+		return ctx.Err()
 
 	case c.network.readUDP <- req:
 
 		// receive ack
 		select {
 		case <-c.closed:
-			return 0, netip.AddrPort{}, net.ErrClosed
+			return c.abortRead(req, net.ErrClosed)
 
 		case <-c.network.closed:
-			return 0, netip.AddrPort{}, net.ErrClosed
+			return net.ErrClosed
 
 		case <-c.readDeadline.wait():
-			return 0, netip.AddrPort{}, os.ErrDeadlineExceeded
+			return c.abortRead(req, os.ErrDeadlineExceeded)
+
+		case <-ctx.Done():
+			return c.abortRead(req, ctx.Err())
 
 		case <-req.ack:
-			return req.count, req.senderAddr, req.err
+			return c.finishRead(req)
 		}
 	}
 }
 
+// finishRead completes a read acknowledged by the network.
+func (c *UDPConn) finishRead(req *networkReadUDP) error {
+	if req.err == nil && !req.spurious {
+		c.bytesRead.Add(uint64(req.count))
+		c.datagramsRead.Add(uint64(req.segments))
+		c.maybeNotifyPeerChange(req.flowID, req.senderAddr)
+	}
+	return req.err
+}
+
+// maybeNotifyPeerChange invokes the peer change observer, if any, when the source
+// address of the datagrams sent by the conn with the given ID has changed.
+func (c *UDPConn) maybeNotifyPeerChange(flowID uint64, source netip.AddrPort) {
+	// connected conns only receive from their peer and we do not
+	// know the flow of datagrams sent by unknown conns
+	if c.peerAddr.IsValid() || flowID == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	fn := c.peerChangeObserver
+	old, found := c.flows[flowID]
+	if fn != nil {
+		c.flows[flowID] = source
+	}
+	c.mu.Unlock()
+
+	if fn != nil && found && old != source {
+		fn(old, source)
+	}
+}
+
+// abortRead asks the network to forget about a read that may be blocked
+// waiting for a datagram, such that the network does not later write into the
+// buffer of a caller that gave up. If the network had already completed the
+// read, we return its result, otherwise we return the given error.
+func (c *UDPConn) abortRead(read *networkReadUDP, err error) error {
+	// create request for canceling the read
+	req := &networkCancelReadUDP{
+		ack:  make(chan any),
+		read: read,
+	}
+
+	// tell the network to cancel the read
+	select {
+	case <-c.network.closed:
+		// nothing
+
+	case c.network.cancelReadUDP <- req:
+		select {
+		case <-c.network.closed:
+			// nothing
+
+		case <-req.ack:
+			// nothing
+		}
+	}
+
+	// check whether the network completed the read before canceling
+	select {
+	case <-read.ack:
+		return c.finishRead(read)
+
+	default:
+		return err
+	}
+}
+
 // Write writes data on a connected UDP socket.
 func (c *UDPConn) Write(data []byte) (int, error) {
 	// make sure we not connected
@@ -261,10 +810,12 @@ func (c *UDPConn) Write(data []byte) (int, error) {
 	}
 
 	// use common write code
-	return c.commonWrite(data, c.peerAddr)
+	return c.commonWrite(data, c.getLocalAddr(), c.peerAddr)
 }
 
-// WriteTo writes data on an unconnected UDP socket.
+// WriteTo writes data on an unconnected UDP socket. The addr argument should be
+// a [*net.UDPAddr]. We reject a [*net.IPAddr] with [syscall.EINVAL] because it
+// lacks a port. For any other type, we parse the string representation.
 func (c *UDPConn) WriteTo(data []byte, addr net.Addr) (int, error) {
 	// make sure we're not connected
 	if c.peerAddr.IsValid() {
@@ -272,23 +823,125 @@ func (c *UDPConn) WriteTo(data []byte, addr net.Addr) (int, error) {
 	}
 
 	// parse the destination address
-	destAddr, err := netip.ParseAddrPort(addr.String())
+	destAddr, err := parseDestAddr(addr)
 	if err != nil {
+		return 0, err
+	}
+
+	// use common write code
+	return c.commonWrite(data, c.getLocalAddr(), destAddr)
+}
+
+// parseDestAddr converts the address passed to WriteTo to a netip.AddrPort.
+func parseDestAddr(addr net.Addr) (netip.AddrPort, error) {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		destAddr := addr.AddrPort()
+		return netip.AddrPortFrom(destAddr.Addr().Unmap(), destAddr.Port()), nil
+
+	case *net.IPAddr:
+		return netip.AddrPort{}, syscall.EINVAL
+
+	case nil:
+		return netip.AddrPort{}, syscall.EINVAL
+
+	default:
+		destAddr, err := netip.ParseAddrPort(addr.String())
+		if err != nil {
+			return netip.AddrPort{}, syscall.EINVAL
+		}
+		return destAddr, nil
+	}
+}
+
+// WriteMsgUDPWithSource is like WriteTo but uses the given source address rather
+// than the local address of the conn (like IP_PKTINFO on send). This is useful
+// for a conn bound to the wildcard address to reply using the same address to
+// which the request was sent (see [UDPConn.ReadFromDst]).
+func (c *UDPConn) WriteMsgUDPWithSource(data []byte, src, dst netip.AddrPort) (int, error) {
+	// make sure we're not connected
+	if c.peerAddr.IsValid() {
+		return 0, syscall.EISCONN
+	}
+
+	// make sure the addresses are valid
+	if !src.IsValid() || !dst.IsValid() {
 		return 0, syscall.EINVAL
 	}
 
 	// use common write code
-	return c.commonWrite(data, destAddr)
+	return c.commonWrite(data, src, dst)
+}
+
+// commonWrite is the common code for writing, which segments the data
+// if the conn uses GSO (see SetGSO).
+func (c *UDPConn) commonWrite(data []byte, sourceAddr, destAddr netip.AddrPort) (int, error) {
+	return c.writeSegments(data, sourceAddr, destAddr, int(c.gsoSize.Load()))
+}
+
+// writeWithTimeout is like Write but gives up when the given timeout expires, in
+// which case it returns [os.ErrDeadlineExceeded], without segmenting the data. This
+// method does not modify the write deadline, which still applies.
+func (c *UDPConn) writeWithTimeout(data []byte, timeout time.Duration) (int, error) {
+	// make sure we're connected
+	if !c.peerAddr.IsValid() {
+		return 0, syscall.ENOTCONN
+	}
+
+	// bound the write using a context, such that concurrent writes
+	// using the same conn do not interfere with each other
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	count, err := c.writeDatagramContext(ctx, data, c.getLocalAddr(), c.peerAddr)
+	if err == context.DeadlineExceeded {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return count, err
+}
+
+// writeDatagram writes data as a single datagram.
+func (c *UDPConn) writeDatagram(data []byte, sourceAddr, destAddr netip.AddrPort) (int, error) {
+	return c.writeDatagramContext(context.Background(), data, sourceAddr, destAddr)
 }
 
-// commonWrite is the common code for writing.
-func (c *UDPConn) commonWrite(data []byte, destAddr netip.AddrPort) (int, error) {
+// writeDatagramContext is like writeDatagram but also returns the context
+// error as soon as the given context is done.
+func (c *UDPConn) writeDatagramContext(ctx context.Context, data []byte, sourceAddr, destAddr netip.AddrPort) (int, error) {
+	// like the kernel, refuse sending to port zero, which would otherwise
+	// match a conn that is itself bound to port zero
+	if destAddr.Port() == 0 {
+		return 0, syscall.EINVAL
+	}
+
+	// make sure the datagram is not too large
+	if err := c.checkDatagramSize(len(data), destAddr); err != nil {
+		return 0, err
+	}
+
+	// fail if the conn is closed, because the select below chooses randomly
+	// among the ready cases and the network could deliver the datagram
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	// apply the default write timeout, if any
+	if timeout := time.Duration(c.writeTimeout.Load()); timeout > 0 {
+		c.writeDeadline.set(time.Now().Add(timeout))
+	}
+
 	// prepare request
 	req := &networkWriteUDP{
 		ack:        make(chan any),
+		blockedOn:  nil,
+		boundAddr:  c.getLocalAddr(),
 		destAddr:   destAddr,
 		payload:    data,
-		sourceAddr: c.localAddr,
+		seq:        0,
+		size:       len(data),
+		sourceAddr: sourceAddr,
+		tos:        c.getTOS(),
 	}
 
 	// issue the request
@@ -299,24 +952,125 @@ func (c *UDPConn) commonWrite(data []byte, destAddr netip.AddrPort) (int, error)
 	case <-c.network.closed:
 		return 0, net.ErrClosed
 
-	case <-c.readDeadline.wait():
+	case <-c.writeDeadline.wait():
 		return 0, os.ErrDeadlineExceeded
 
+	case <-ctx.Done():
+		return 0, ctx.Err()
+
 	case c.network.writeUDP <- req:
 
 		// receive ack
 		select {
 		case <-c.closed:
-			return 0, net.ErrClosed
+			return c.abortWrite(req, net.ErrClosed)
 
 		case <-c.network.closed:
 			return 0, net.ErrClosed
 
-		case <-c.readDeadline.wait():
-			return 0, os.ErrDeadlineExceeded
+		case <-c.writeDeadline.wait():
+			return c.abortWrite(req, os.ErrDeadlineExceeded)
+
+		case <-ctx.Done():
+			return c.abortWrite(req, ctx.Err())
 
 		case <-req.ack:
-			return len(data), req.err
+			return c.finishWrite(req)
 		}
 	}
 }
+
+// checkDatagramSize returns [syscall.EMSGSIZE] if we cannot send a datagram
+// with the given payload size to the given destination. Because UDP sends are
+// all-or-nothing, we refuse to send the datagram rather than truncating it.
+func (c *UDPConn) checkDatagramSize(size int, destAddr netip.AddrPort) error {
+	if size > maxPayloadSize(destAddr) {
+		return syscall.EMSGSIZE
+	}
+	if mtu := c.network.getMTU(); c.dontFragment.Load() && mtu > 0 && packetSize(size, destAddr) > mtu {
+		return syscall.EMSGSIZE
+	}
+	return nil
+}
+
+// maxPayloadSize returns the maximum payload size of an UDP datagram, which is
+// limited by the 16 bit length field of the IPv4 header (which includes the IPv4
+// and UDP headers) or of the IPv6 header (which only includes the UDP header).
+func maxPayloadSize(destAddr netip.AddrPort) int {
+	const udpHeaderSize = 8
+	if destAddr.Addr().Is4() {
+		const ipv4HeaderSize = 20
+		return 0xffff - ipv4HeaderSize - udpHeaderSize
+	}
+	return 0xffff - udpHeaderSize
+}
+
+// packetSize returns the size of the IP packet carrying an UDP datagram.
+func packetSize(payloadSize int, destAddr netip.AddrPort) int {
+	const udpHeaderSize = 8
+	if destAddr.Addr().Is4() {
+		const ipv4HeaderSize = 20
+		return ipv4HeaderSize + udpHeaderSize + payloadSize
+	}
+	const ipv6HeaderSize = 40
+	return ipv6HeaderSize + udpHeaderSize + payloadSize
+}
+
+// finishWrite completes a write acknowledged by the network.
+func (c *UDPConn) finishWrite(req *networkWriteUDP) (int, error) {
+	if req.dropReason != dropReasonNone {
+		c.notifyWriteError(req.size, req.destAddr, req.dropReason)
+	}
+	if req.err != nil {
+		return 0, req.err
+	}
+	c.bytesWritten.Add(uint64(req.size))
+	c.datagramsWritten.Add(1)
+	return req.size, nil
+}
+
+// abortWrite asks the network to forget about a write that may be blocked
+// waiting for a reader, such that the network does not deliver it later. If
+// the network had already completed the write, we return its result, otherwise
+// we return the given error.
+func (c *UDPConn) abortWrite(write *networkWriteUDP, err error) (int, error) {
+	// create request for canceling the write
+	req := &networkCancelWriteUDP{
+		ack:   make(chan any),
+		write: write,
+	}
+
+	// tell the network to cancel the write
+	select {
+	case <-c.network.closed:
+		// nothing
+
+	case c.network.cancelWriteUDP <- req:
+		select {
+		case <-c.network.closed:
+			// nothing
+
+		case <-req.ack:
+			// nothing
+		}
+	}
+
+	// check whether the network completed the write before canceling
+	select {
+	case <-write.ack:
+		return c.finishWrite(write)
+
+	default:
+		return 0, err
+	}
+}
+
+// notifyWriteError invokes the write error observer, if any.
+func (c *UDPConn) notifyWriteError(payloadLen int, dst netip.AddrPort, reason DropReason) {
+	c.mu.Lock()
+	fn := c.writeErrorObserver
+	c.mu.Unlock()
+	if fn != nil {
+		fn(payloadLen, dst, reason)
+	}
+}
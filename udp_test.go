@@ -0,0 +1,888 @@
+package netemlite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestConnectedConnFiltersNonPeers(t *testing.T) {
+	n := newTestNetwork(t)
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	peer := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	stranger := newTestConn(t, n, "10.0.0.3:1234", "10.0.0.2:53")
+
+	// the datagram sent by a stranger is dropped by the network
+	if _, err := stranger.Write([]byte("stray")); err != nil {
+		t.Fatal(err)
+	}
+	if got := n.Stats().Drops[DropReasonPeerMismatch]; got != 1 {
+		t.Fatalf("expected one peer mismatch drop, got %d", got)
+	}
+
+	// the datagram sent by the peer is delivered
+	writeAsync(peer, "hello")
+	mustRead(t, receiver, "hello")
+}
+
+func TestTimedOutWriteIsNotDelivered(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+
+	// time out a write that nobody reads
+	sender.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := sender.Write([]byte("stale")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	waitBlockedWrites(t, n, "10.0.0.2:53", 0)
+
+	// a reader appearing later must only see the next datagram
+	sender.SetWriteDeadline(time.Time{})
+	writeAsync(sender, "fresh")
+	mustRead(t, receiver, "fresh")
+}
+
+func TestClosedWriterDatagramIsNotDelivered(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	other := newTestConn(t, n, "10.0.0.3:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+
+	// close the conn while its write is blocked
+	errch := writeAsync(sender, "stale")
+	waitBlockedWrites(t, n, "10.0.0.2:53", 1)
+	sender.Close()
+	if err := <-errch; err == nil {
+		t.Fatal("expected an error")
+	}
+	waitBlockedWrites(t, n, "10.0.0.2:53", 0)
+
+	writeAsync(other, "fresh")
+	mustRead(t, receiver, "fresh")
+}
+
+func TestSetLinger(t *testing.T) {
+	n := newTestNetwork(t)
+	conn := newTestConn(t, n, "10.0.0.1:1234", "")
+	if err := conn.SetLinger(5); !errors.Is(err, syscall.ENOPROTOOPT) {
+		t.Fatalf("expected ENOPROTOOPT, got %v", err)
+	}
+}
+
+func TestIOStats(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+
+	for _, payload := range []string{"a", "bb", "ccc"} {
+		errch := writeAsync(sender, payload)
+		mustRead(t, receiver, payload)
+		if err := <-errch; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// datagrams that are dropped are still successfully written
+	sender.Close()
+	dropper := newTestConn(t, n, "10.0.0.3:1234", "10.0.0.4:53")
+	if _, err := dropper.Write([]byte("dddd")); err != nil {
+		t.Fatal(err)
+	}
+
+	if br, bw, dr, dw := receiver.IOStats(); br != 6 || bw != 0 || dr != 3 || dw != 0 {
+		t.Fatal("unexpected receiver stats", br, bw, dr, dw)
+	}
+	if br, bw, dr, dw := sender.IOStats(); br != 0 || bw != 6 || dr != 0 || dw != 3 {
+		t.Fatal("unexpected sender stats", br, bw, dr, dw)
+	}
+	if br, bw, dr, dw := dropper.IOStats(); br != 0 || bw != 4 || dr != 0 || dw != 1 {
+		t.Fatal("unexpected dropper stats", br, bw, dr, dw)
+	}
+}
+
+func TestIOStatsIgnoreFailures(t *testing.T) {
+	n := newTestNetwork(t)
+	conn := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+
+	// the peer never reads, so the write cannot complete even if the
+	// network receives it before noticing the expired deadline
+	newTestConn(t, n, "10.0.0.2:53", "")
+	conn.SetDeadline(time.Now().Add(-time.Second))
+	conn.Write([]byte("hello"))
+	conn.Read(make([]byte, 16))
+	if br, bw, dr, dw := conn.IOStats(); br != 0 || bw != 0 || dr != 0 || dw != 0 {
+		t.Fatal("unexpected stats", br, bw, dr, dw)
+	}
+}
+
+func TestConcurrentReadersAreServedInFIFOOrder(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+
+	// block the readers one after the other
+	const readers = 4
+	results := make([]chan string, readers)
+	for idx := 0; idx < readers; idx++ {
+		results[idx] = make(chan string, 1)
+		go func(ch chan<- string) {
+			buffer := make([]byte, 64)
+			count, _, _ := receiver.ReadFrom(buffer)
+			ch <- string(buffer[:count])
+		}(results[idx])
+		waitBlockedReads(t, n, "10.0.0.2:53", idx+1)
+	}
+
+	// each datagram must go to the longest waiting reader
+	for idx := 0; idx < readers; idx++ {
+		expect := fmt.Sprintf("datagram-%d", idx)
+		if _, err := sender.Write([]byte(expect)); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-results[idx]; got != expect {
+			t.Fatalf("reader %d: expected %q, got %q", idx, expect, got)
+		}
+	}
+}
+
+func TestConcurrentReadersStress(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+	receiver.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	// each reader performs the same number of reads, so every reader
+	// must make progress for the test to terminate
+	const readers, reads = 8, 100
+	received := make([][]string, readers)
+	errs := make(chan error, readers)
+	for idx := 0; idx < readers; idx++ {
+		go func(idx int) {
+			buffer := make([]byte, 64)
+			for count := 0; count < reads; count++ {
+				size, _, err := receiver.ReadFrom(buffer)
+				if err != nil {
+					errs <- err
+					return
+				}
+				received[idx] = append(received[idx], string(buffer[:size]))
+			}
+			errs <- nil
+		}(idx)
+	}
+	for idx := 0; idx < readers*reads; idx++ {
+		if _, err := sender.Write([]byte(fmt.Sprintf("datagram-%d", idx))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for idx := 0; idx < readers; idx++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// each datagram must have been delivered to exactly one reader
+	seen := map[string]bool{}
+	for _, datagrams := range received {
+		for _, datagram := range datagrams {
+			if seen[datagram] {
+				t.Fatalf("%s delivered twice", datagram)
+			}
+			seen[datagram] = true
+		}
+	}
+	if len(seen) != readers*reads {
+		t.Fatalf("expected %d datagrams, got %d", readers*reads, len(seen))
+	}
+}
+
+func TestTimedOutReadDoesNotConsumeDatagrams(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+
+	// time out a blocked read and make sure the network forgets it
+	receiver.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := receiver.Read(make([]byte, 64)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	waitBlockedReads(t, n, "10.0.0.2:53", 0)
+
+	// the next datagram must be waiting for the next read
+	receiver.SetReadDeadline(time.Time{})
+	errch := writeAsync(sender, "hello")
+	waitBlockedWrites(t, n, "10.0.0.2:53", 1)
+	mustRead(t, receiver, "hello")
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadFromDst(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "")
+	receiver := newTestConn(t, n, "0.0.0.0:53", "")
+
+	// the destination is the concrete address the sender used
+	writeToAsync(sender, "hello", "10.0.0.2:53")
+	buffer := make([]byte, 64)
+	count, src, dst, err := receiver.ReadFromDst(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer[:count]) != "hello" || src.String() != "10.0.0.1:1234" || dst.String() != "10.0.0.2:53" {
+		t.Fatal("unexpected result", string(buffer[:count]), src, dst)
+	}
+}
+
+func TestReadFromDstConnected(t *testing.T) {
+	n := newTestNetwork(t)
+	conn := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	if _, _, _, err := conn.ReadFromDst(make([]byte, 64)); !errors.Is(err, syscall.EISCONN) {
+		t.Fatalf("expected EISCONN, got %v", err)
+	}
+}
+
+func TestWriteMsgUDPWithSource(t *testing.T) {
+	n := newTestNetwork(t)
+	client := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	server := newTestConn(t, n, "0.0.0.0:53", "")
+
+	// the client only accepts replies from 10.0.0.2:53
+	errch := writeAsync(client, "query")
+	buffer := make([]byte, 64)
+	count, src, dst, err := server.ReadFromDst(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+
+	// reply using the address to which the query was sent
+	go server.WriteMsgUDPWithSource([]byte("reply to "+string(buffer[:count])), dst, src)
+	mustRead(t, client, "reply to query")
+}
+
+func TestWriteMsgUDPWithSourceInvalidArguments(t *testing.T) {
+	n := newTestNetwork(t)
+	conn := newTestConn(t, n, "0.0.0.0:53", "")
+	if _, err := conn.WriteMsgUDPWithSource(nil, netip.AddrPort{}, netip.MustParseAddrPort("10.0.0.1:1234")); !errors.Is(err, syscall.EINVAL) {
+		t.Fatalf("expected EINVAL, got %v", err)
+	}
+	connected := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	if _, err := connected.WriteMsgUDPWithSource(nil, netip.MustParseAddrPort("10.0.0.2:53"), netip.MustParseAddrPort("10.0.0.1:1234")); !errors.Is(err, syscall.EISCONN) {
+		t.Fatalf("expected EISCONN, got %v", err)
+	}
+}
+
+func TestZeroLengthReadConsumesDatagram(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "first", "second")
+
+	// a nil buffer consumes the first datagram and reports truncation
+	count, _, flags, _, err := receiver.ReadMsgUDP(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 || flags&MsgTrunc == 0 {
+		t.Fatalf("expected a truncated empty read, got count=%d flags=%d", count, flags)
+	}
+
+	// a zero-length buffer passed to Read also consumes a datagram
+	if count, err := receiver.Read([]byte{}); err != nil || count != 0 {
+		t.Fatalf("expected an empty read, got count=%d err=%v", count, err)
+	}
+	waitBlockedWrites(t, n, "10.0.0.2:53", 0)
+}
+
+func TestShortReadDiscardsRemainder(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "first datagram", "second datagram")
+
+	// a short read returns the beginning of the first datagram
+	buffer := make([]byte, 5)
+	if count, err := receiver.Read(buffer); err != nil || string(buffer[:count]) != "first" {
+		t.Fatalf("unexpected short read: %q %v", buffer[:count], err)
+	}
+
+	// the next read returns the second datagram, not the remainder of the first
+	mustRead(t, receiver, "second datagram")
+	waitBlockedWrites(t, n, "10.0.0.2:53", 0)
+}
+
+func TestZeroLengthReadOfEmptyDatagramIsNotTruncated(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "")
+	count, _, flags, _, err := receiver.ReadMsgUDP(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 || flags&MsgTrunc != 0 {
+		t.Fatalf("expected an empty read, got count=%d flags=%d", count, flags)
+	}
+}
+
+func TestRebind(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "queued")
+
+	// the queued datagram follows the conn to the new address
+	if err := receiver.Rebind(netip.MustParseAddrPort("10.0.0.3:53")); err != nil {
+		t.Fatal(err)
+	}
+	if receiver.LocalAddr().String() != "10.0.0.3:53" {
+		t.Fatal("unexpected local address", receiver.LocalAddr())
+	}
+	mustRead(t, receiver, "queued")
+
+	// datagrams sent to the new address reach the conn
+	writeToAsync(sender, "hello", "10.0.0.3:53")
+	mustRead(t, receiver, "hello")
+
+	// datagrams sent to the old address are dropped
+	if err := <-writeToAsync(sender, "lost", "10.0.0.2:53"); err != nil {
+		t.Fatal(err)
+	}
+	if drops := n.Stats().Drops[DropReasonNoSuchConn]; drops != 1 {
+		t.Fatalf("expected 1 drop, got %d", drops)
+	}
+}
+
+func TestRebindAddressInUse(t *testing.T) {
+	n := newTestNetwork(t)
+	conn := newTestConn(t, n, "10.0.0.1:1234", "")
+	newTestConn(t, n, "10.0.0.2:53", "")
+	if err := conn.Rebind(netip.MustParseAddrPort("10.0.0.2:53")); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Fatalf("expected EADDRINUSE, got %v", err)
+	}
+	if conn.LocalAddr().String() != "10.0.0.1:1234" {
+		t.Fatal("unexpected local address", conn.LocalAddr())
+	}
+}
+
+func TestRebindInvalidAddress(t *testing.T) {
+	n := newTestNetwork(t)
+	conn := newTestConn(t, n, "10.0.0.1:1234", "")
+	if err := conn.Rebind(netip.AddrPort{}); !errors.Is(err, syscall.EINVAL) {
+		t.Fatalf("expected EINVAL, got %v", err)
+	}
+	if conn.LocalAddr().String() != "10.0.0.1:1234" {
+		t.Fatal("unexpected local address", conn.LocalAddr())
+	}
+}
+
+func TestRebindPortZero(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+
+	// the conn gets an ephemeral port and is reachable there
+	if err := receiver.Rebind(netip.MustParseAddrPort("10.0.0.3:0")); err != nil {
+		t.Fatal(err)
+	}
+	local := receiver.LocalAddr().(*net.UDPAddr)
+	if local.IP.String() != "10.0.0.3" || local.Port == 0 {
+		t.Fatal("unexpected local address", local)
+	}
+	writeToAsync(sender, "hello", local.String())
+	mustRead(t, receiver, "hello")
+}
+
+func TestRebindWhileDraining(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "hello")
+	errch := make(chan error, 1)
+	go func() {
+		errch <- n.CloseWithTimeout(5 * time.Second)
+	}()
+	waitDraining(t, n)
+	if err := sender.Rebind(netip.MustParseAddrPort("10.0.0.3:1234")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	mustRead(t, receiver, "hello")
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRebindTakesOverOrphan(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "")
+	old := newTestConn(t, n, "10.0.0.2:53", "")
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "restored")
+	state := n.SaveState()
+
+	// closing and restoring creates an orphan with a queued datagram
+	old.Close()
+	if err := n.RestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	conn := newTestConn(t, n, "10.0.0.4:53", "")
+	queueDatagrams(t, n, sender, "10.0.0.4:53", "own")
+
+	// moving the conn onto the orphan takes over its datagrams
+	if err := conn.Rebind(netip.MustParseAddrPort("10.0.0.2:53")); err != nil {
+		t.Fatal(err)
+	}
+	mustRead(t, conn, "own")
+	mustRead(t, conn, "restored")
+	waitBlockedWrites(t, n, "10.0.0.2:53", 0)
+}
+
+func TestPeerChangeObserver(t *testing.T) {
+	n := newTestNetwork(t)
+	client := newTestConn(t, n, "10.0.0.1:1234", "")
+	other := newTestConn(t, n, "10.0.0.4:1234", "")
+	server := newTestConn(t, n, "10.0.0.2:53", "")
+	var changes []string
+	server.SetPeerChangeObserver(func(old, new netip.AddrPort) {
+		changes = append(changes, old.String()+" -> "+new.String())
+	})
+
+	// the first datagram of a flow is not a change
+	writeToAsync(client, "first", "10.0.0.2:53")
+	mustRead(t, server, "first")
+
+	// a datagram from another flow is not a change either
+	writeToAsync(other, "other", "10.0.0.2:53")
+	mustRead(t, server, "other")
+
+	// the flow migrates to a new source address
+	if err := client.Rebind(netip.MustParseAddrPort("10.0.0.3:1234")); err != nil {
+		t.Fatal(err)
+	}
+	writeToAsync(client, "migrated", "10.0.0.2:53")
+	mustRead(t, server, "migrated")
+
+	if len(changes) != 1 || changes[0] != "10.0.0.1:1234 -> 10.0.0.3:1234" {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+}
+
+// customAddr is a custom [net.Addr] implementation.
+type customAddr string
+
+func (addr customAddr) Network() string { return "udp" }
+
+func (addr customAddr) String() string { return string(addr) }
+
+func TestParseDestAddr(t *testing.T) {
+	cases := []struct {
+		addr   net.Addr
+		expect netip.AddrPort
+		err    error
+	}{{
+		addr:   &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 53},
+		expect: netip.MustParseAddrPort("10.0.0.2:53"),
+		err:    nil,
+	}, {
+		addr:   &net.IPAddr{IP: net.ParseIP("10.0.0.2")},
+		expect: netip.AddrPort{},
+		err:    syscall.EINVAL,
+	}, {
+		addr:   customAddr("10.0.0.2:53"),
+		expect: netip.MustParseAddrPort("10.0.0.2:53"),
+		err:    nil,
+	}, {
+		addr:   customAddr("10.0.0.2"),
+		expect: netip.AddrPort{},
+		err:    syscall.EINVAL,
+	}, {
+		addr:   nil,
+		expect: netip.AddrPort{},
+		err:    syscall.EINVAL,
+	}}
+	for _, tc := range cases {
+		got, err := parseDestAddr(tc.addr)
+		if !errors.Is(err, tc.err) || got != tc.expect {
+			t.Fatalf("%v: expected %v and %v, got %v and %v", tc.addr, tc.expect, tc.err, got, err)
+		}
+	}
+}
+
+func TestWriteToIPAddr(t *testing.T) {
+	n := newTestNetwork(t)
+	conn := newTestConn(t, n, "10.0.0.1:1234", "")
+	if _, err := conn.WriteTo([]byte("hello"), &net.IPAddr{IP: net.ParseIP("10.0.0.2")}); !errors.Is(err, syscall.EINVAL) {
+		t.Fatalf("expected EINVAL, got %v", err)
+	}
+}
+
+func TestConnectedConnSurvivesPeerRebind(t *testing.T) {
+	n := newTestNetwork(t)
+	client := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	oldServer := newTestConn(t, n, "10.0.0.2:53", "")
+
+	// leave a read blocked while the old server goes away
+	readch := make(chan string, 1)
+	go func() {
+		buffer := make([]byte, 64)
+		count, err := client.Read(buffer)
+		if err != nil {
+			readch <- err.Error()
+			return
+		}
+		readch <- string(buffer[:count])
+	}()
+	waitBlockedReads(t, n, "10.0.0.1:1234", 1)
+	if err := oldServer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new server binds the same address
+	newServer := newTestConn(t, n, "10.0.0.2:53", "")
+
+	// the client writes reach the new server
+	errch := writeAsync(client, "query")
+	mustRead(t, newServer, "query")
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+
+	// the blocked read accepts the datagrams sent by the new server
+	if _, err := newServer.WriteTo([]byte("reply"), client.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-readch; got != "reply" {
+		t.Fatalf("expected %q, got %q", "reply", got)
+	}
+}
+
+func TestReadBlockObserver(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	observed := make(chan bool, 8)
+	receiver.SetReadBlockObserver(func(blocked bool) {
+		observed <- blocked
+	})
+
+	// a datagram is already available, so the read does not block
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "queued")
+	mustRead(t, receiver, "queued")
+	if blocked := <-observed; blocked {
+		t.Fatal("expected the read not to block")
+	}
+
+	// no datagram is available, so the read blocks
+	readch := make(chan string, 1)
+	go func() {
+		buffer := make([]byte, 64)
+		count, _ := receiver.Read(buffer)
+		readch <- string(buffer[:count])
+	}()
+	if blocked := <-observed; !blocked {
+		t.Fatal("expected the read to block")
+	}
+	writeAsync(sender, "later")
+	if got := <-readch; got != "later" {
+		t.Fatalf("expected %q, got %q", "later", got)
+	}
+	select {
+	case blocked := <-observed:
+		t.Fatalf("unexpected extra notification: %v", blocked)
+	default:
+	}
+}
+
+func TestDontFragment(t *testing.T) {
+	n := newTestNetwork(t)
+	n.SetMTU(100)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	if mtu, err := sender.MTU(); err != nil || mtu != 100 {
+		t.Fatalf("expected 100, got %d and %v", mtu, err)
+	}
+
+	// the IPv4 and UDP headers take 28 bytes, so 72 bytes is the largest payload
+	// and the oversized write fails immediately even though nobody reads
+	sender.SetDontFragment(true)
+	if _, err := sender.Write(make([]byte, 73)); !errors.Is(err, syscall.EMSGSIZE) {
+		t.Fatalf("expected EMSGSIZE, got %v", err)
+	}
+	payload := string(make([]byte, 72))
+	errch := writeAsync(sender, payload)
+	mustRead(t, receiver, payload)
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+
+	// without the Don't Fragment bit, the MTU does not matter
+	sender.SetDontFragment(false)
+	payload = string(make([]byte, 500))
+	errch = writeAsync(sender, payload)
+	buffer := make([]byte, 1024)
+	if count, err := receiver.Read(buffer); err != nil || count != 500 {
+		t.Fatalf("expected 500 bytes, got %d and %v", count, err)
+	}
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMTUUnconnected(t *testing.T) {
+	n := newTestNetwork(t)
+	conn := newTestConn(t, n, "10.0.0.1:1234", "")
+	if _, err := conn.MTU(); !errors.Is(err, syscall.ENOTCONN) {
+		t.Fatalf("expected ENOTCONN, got %v", err)
+	}
+}
+
+func TestMTUUnlimited(t *testing.T) {
+	n := newTestNetwork(t)
+	conn := newTestConn(t, n, "[::1]:1234", "[::1]:53")
+	if mtu, err := conn.MTU(); err != nil || mtu != 0xffff+40 {
+		t.Fatalf("expected %d, got %d and %v", 0xffff+40, mtu, err)
+	}
+}
+
+func TestOversizedWriteIsAllOrNothing(t *testing.T) {
+	n := newTestNetwork(t)
+	conn4 := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	conn6 := newTestConn(t, n, "[::1]:1234", "[::2]:53")
+	cases := []struct {
+		conn *UDPConn
+		size int
+	}{
+		{conn: conn4, size: 65507 + 1},
+		{conn: conn6, size: 65527 + 1},
+		{conn: conn4, size: 1 << 20},
+	}
+	for _, tc := range cases {
+		count, err := tc.conn.Write(make([]byte, tc.size))
+		if count != 0 || !errors.Is(err, syscall.EMSGSIZE) {
+			t.Fatalf("%d bytes: expected 0 and EMSGSIZE, got %d and %v", tc.size, count, err)
+		}
+	}
+}
+
+func TestLargestWriteIsDelivered(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "[::1]:1234", "[::2]:53")
+	receiver := newTestConn(t, n, "[::2]:53", "[::1]:1234")
+	errch := make(chan error, 1)
+	go func() {
+		count, err := sender.Write(make([]byte, 65527))
+		if err == nil && count != 65527 {
+			err = fmt.Errorf("unexpected count %d", count)
+		}
+		errch <- err
+	}()
+	buffer := make([]byte, 1<<16)
+	if count, err := receiver.Read(buffer); err != nil || count != 65527 {
+		t.Fatalf("expected 65527 bytes, got %d and %v", count, err)
+	}
+	if err := <-errch; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentWritersDoNotInterleave(t *testing.T) {
+	n := newTestNetwork(t)
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+
+	// each writer sends datagrams filled with its own byte, where the first
+	// byte is the writer ID and the size depends on the datagram index
+	const writers, count = 16, 100
+	for wid := 0; wid < writers; wid++ {
+		sender := newTestConn(t, n, fmt.Sprintf("10.0.0.1:%d", 1000+wid), "10.0.0.2:53")
+		go func(wid byte) {
+			for idx := 0; idx < count; idx++ {
+				payload := bytes.Repeat([]byte{wid}, 1+(idx*37)%1400)
+				if _, err := sender.Write(payload); err != nil {
+					return
+				}
+			}
+		}(byte(wid))
+	}
+
+	// each datagram must contain exactly one writer's bytes
+	received := make([]int, writers)
+	buffer := make([]byte, 2048)
+	for idx := 0; idx < writers*count; idx++ {
+		size, _, err := receiver.ReadFrom(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wid := buffer[0]
+		if int(wid) >= writers {
+			t.Fatalf("unexpected writer ID %d", wid)
+		}
+		if expect := 1 + (received[wid]*37)%1400; size != expect {
+			t.Fatalf("writer %d: expected %d bytes, got %d", wid, expect, size)
+		}
+		if !bytes.Equal(buffer[:size], bytes.Repeat([]byte{wid}, size)) {
+			t.Fatalf("writer %d: interleaved datagram", wid)
+		}
+		received[wid]++
+	}
+}
+
+func TestWriteToPortZero(t *testing.T) {
+	n := newTestNetwork(t)
+	unconnected := newTestConn(t, n, "10.0.0.1:1234", "")
+	if _, err := unconnected.WriteTo([]byte("hello"), &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 0}); !errors.Is(err, syscall.EINVAL) {
+		t.Fatalf("expected EINVAL, got %v", err)
+	}
+	connected := newTestConn(t, n, "10.0.0.1:4321", "10.0.0.2:0")
+	if _, err := connected.Write([]byte("hello")); !errors.Is(err, syscall.EINVAL) {
+		t.Fatalf("expected EINVAL, got %v", err)
+	}
+	if drops := n.Stats().Drops; len(drops) != 0 {
+		t.Fatalf("expected no drops, got %v", drops)
+	}
+}
+
+func TestDefaultDeadlines(t *testing.T) {
+	n := newTestNetwork(t)
+	before := newTestConn(t, n, "10.0.0.3:1234", "")
+	n.SetDefaultDeadlines(20*time.Millisecond, 20*time.Millisecond)
+	conn := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	newTestConn(t, n, "10.0.0.2:53", "")
+
+	// reads and writes time out without an explicit deadline and the
+	// timeout is rolling, so it applies to each operation
+	for idx := 0; idx < 2; idx++ {
+		if _, err := conn.Read(make([]byte, 64)); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("expected ErrDeadlineExceeded, got %v", err)
+		}
+		if _, err := conn.Write([]byte("hello")); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("expected ErrDeadlineExceeded, got %v", err)
+		}
+	}
+
+	// conns created before setting the defaults are not affected
+	readch := make(chan error, 1)
+	go func() {
+		_, _, err := before.ReadFrom(make([]byte, 64))
+		readch <- err
+	}()
+	select {
+	case err := <-readch:
+		t.Fatalf("unexpected read result: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	before.Close()
+	if err := <-readch; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestSetDeadlineZeroDisablesDefaultDeadlines(t *testing.T) {
+	n := newTestNetwork(t)
+	n.SetDefaultDeadlines(20*time.Millisecond, 20*time.Millisecond)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+	if err := receiver.SetDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the read outlives the default timeout
+	readch := make(chan error, 1)
+	go func() {
+		_, err := receiver.Read(make([]byte, 64))
+		readch <- err
+	}()
+	select {
+	case err := <-readch:
+		t.Fatalf("unexpected read result: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the sender still uses its default write timeout, which is
+	// enough because the receiver is already waiting
+	if _, err := sender.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-readch; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadWithTimeout(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "10.0.0.1:1234", "10.0.0.2:53")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "10.0.0.1:1234")
+
+	// the timeout expires first
+	if _, err := receiver.ReadWithTimeout(context.Background(), make([]byte, 64), 10*time.Millisecond); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected ErrDeadlineExceeded, got %v", err)
+	}
+
+	// the context is done first
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := receiver.ReadWithTimeout(ctx, make([]byte, 64), time.Hour); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+
+	// a datagram arrives in time
+	queueDatagrams(t, n, sender, "10.0.0.2:53", "hello")
+	buffer := make([]byte, 64)
+	count, err := receiver.ReadWithTimeout(context.Background(), buffer, time.Hour)
+	if err != nil || string(buffer[:count]) != "hello" {
+		t.Fatalf("unexpected read: %q %v", buffer[:count], err)
+	}
+
+	// the read deadline still applies and is not modified
+	receiver.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, err := receiver.ReadWithTimeout(context.Background(), buffer, time.Hour); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected ErrDeadlineExceeded, got %v", err)
+	}
+	if _, err := receiver.Read(buffer); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected ErrDeadlineExceeded, got %v", err)
+	}
+}
+
+func TestReadWithTimeoutUnconnected(t *testing.T) {
+	n := newTestNetwork(t)
+	conn := newTestConn(t, n, "10.0.0.1:1234", "")
+	if _, err := conn.ReadWithTimeout(context.Background(), make([]byte, 64), time.Second); !errors.Is(err, syscall.ENOTCONN) {
+		t.Fatalf("expected ENOTCONN, got %v", err)
+	}
+}
+
+func TestWildcardSenderUsesConcreteSource(t *testing.T) {
+	n := newTestNetwork(t)
+	sender := newTestConn(t, n, "0.0.0.0:1234", "")
+	receiver := newTestConn(t, n, "10.0.0.2:53", "")
+
+	// the receiver sees the destination address as the source address
+	writeToAsync(sender, "query", "10.0.0.2:53")
+	buffer := make([]byte, 64)
+	count, addr, err := receiver.ReadFrom(buffer)
+	if err != nil || string(buffer[:count]) != "query" {
+		t.Fatal("unexpected query", err, string(buffer[:count]))
+	}
+	if addr.String() != "10.0.0.2:1234" {
+		t.Fatal("unexpected source address", addr)
+	}
+
+	// replying to such an address reaches the sender
+	go receiver.WriteTo([]byte("response"), addr)
+	mustRead(t, sender, "response")
+
+	// a conn connected to such an address accepts the datagrams
+	connected := newTestConn(t, n, "10.0.0.2:54", "10.0.0.2:1234")
+	writeToAsync(sender, "hello", "10.0.0.2:54")
+	mustRead(t, connected, "hello")
+}
@@ -0,0 +1,131 @@
+package netemlite
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// newTestNetwork creates a [Network] that is closed when the test ends.
+func newTestNetwork(t *testing.T) *Network {
+	t.Helper()
+	n := NewNetwork()
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+// newTestConn creates a [UDPConn] bound to the given local address and connected
+// to the given peer, unless peer is empty, which is closed when the test ends.
+func newTestConn(t *testing.T, n *Network, local, peer string) *UDPConn {
+	t.Helper()
+	var peerAddr netip.AddrPort
+	if peer != "" {
+		peerAddr = netip.MustParseAddrPort(peer)
+	}
+	conn, err := NewUDPConn(n, netip.MustParseAddrPort(local), peerAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// waitConn waits until the snapshot of the conn bound to the given
+// address satisfies the given condition or fails the test.
+func waitConn(t *testing.T, n *Network, addr string, cond func(conn ConnSnapshot) bool) {
+	t.Helper()
+	localAddr := netip.MustParseAddrPort(addr)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		for _, conn := range n.Dump().Conns {
+			if conn.LocalAddr == localAddr && cond(conn) {
+				return
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", addr)
+}
+
+// waitBlockedWrites waits until the given number of datagrams are waiting
+// to be read by the conn bound to the given address.
+func waitBlockedWrites(t *testing.T, n *Network, addr string, count int) {
+	t.Helper()
+	waitConn(t, n, addr, func(conn ConnSnapshot) bool {
+		return conn.BlockedWrites == count
+	})
+}
+
+// waitBlockedReads waits until the given number of reads are blocked
+// on the conn bound to the given address.
+func waitBlockedReads(t *testing.T, n *Network, addr string, count int) {
+	t.Helper()
+	waitConn(t, n, addr, func(conn ConnSnapshot) bool {
+		return conn.BlockedReads == count
+	})
+}
+
+// writeAsync writes the payload using a background goroutine, which is
+// necessary because writes block until a reader takes the datagram, and
+// returns a channel receiving the write error.
+func writeAsync(conn *UDPConn, payload string) <-chan error {
+	errch := make(chan error, 1)
+	go func() {
+		_, err := conn.Write([]byte(payload))
+		errch <- err
+	}()
+	return errch
+}
+
+// writeToAsync is like writeAsync but sends to the given destination.
+func writeToAsync(conn *UDPConn, payload, dest string) <-chan error {
+	errch := make(chan error, 1)
+	go func() {
+		_, err := conn.WriteTo([]byte(payload), net.UDPAddrFromAddrPort(netip.MustParseAddrPort(dest)))
+		errch <- err
+	}()
+	return errch
+}
+
+// queueDatagrams writes each payload using conn, waiting for each datagram to be
+// queued by the conn bound to dest before writing the next one, so the order in
+// which the datagrams are queued is deterministic.
+func queueDatagrams(t *testing.T, n *Network, conn *UDPConn, dest string, payloads ...string) {
+	t.Helper()
+	queued := 0
+	for _, snapshot := range n.Dump().Conns {
+		if snapshot.LocalAddr == netip.MustParseAddrPort(dest) {
+			queued = snapshot.BlockedWrites
+		}
+	}
+	for _, payload := range payloads {
+		if conn.RemoteAddr() != nil {
+			writeAsync(conn, payload)
+		} else {
+			writeToAsync(conn, payload, dest)
+		}
+		queued++
+		waitBlockedWrites(t, n, dest, queued)
+	}
+}
+
+// mustRead reads a datagram and fails the test if it differs from the expected one.
+func mustRead(t *testing.T, conn *UDPConn, expect string) {
+	t.Helper()
+	buffer := make([]byte, 1024)
+	var (
+		count int
+		err   error
+	)
+	if conn.RemoteAddr() != nil {
+		count, err = conn.Read(buffer)
+	} else {
+		count, _, err = conn.ReadFrom(buffer)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buffer[:count]); got != expect {
+		t.Fatalf("expected %q, got %q", expect, got)
+	}
+}